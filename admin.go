@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminCSRF is a per-process token every admin form carries, so other sites
+// can't submit forms with the browser's saved credentials.
+var adminCSRF = newFeedToken()
+
+// adminAuth lets requests through when they carry config.adminToken as a
+// bearer token, or as the basic auth password if basic is set.
+func adminAuth(config *emailConfig, basic bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		} else if _, password, ok := r.BasicAuth(); ok && basic {
+			token = password
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.adminToken)) != 1 {
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="rss-email admin"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminFeed is one subscription of a user as shown on the dashboard.
+type adminFeed struct {
+	URL      string
+	Tag      string
+	LastHash string
+	Webhook  string
+}
+
+type adminUser struct {
+	Email    string
+	Delivery string
+	Pending  int
+	Feeds    []adminFeed
+}
+
+type adminURL struct {
+	URL        string
+	LastUpdate time.Time
+	Error      string
+	Items      int
+}
+
+type adminPage struct {
+	CSRF    string
+	Message string
+	Users   []adminUser
+	URLs    []adminURL
+}
+
+// adminState collects the dashboard's data.
+func adminState(config *emailConfig) *adminPage {
+	page := &adminPage{CSRF: adminCSRF}
+
+	userSubscriptions.RLock()
+	for user, userUrls := range userSubscriptions.m {
+		via, path := deliveryFor(config, user)
+		if path != "" {
+			via += " " + path
+		}
+		u := adminUser{Email: user, Delivery: via, Pending: outbox.pendingCount(user)}
+		for url, info := range *userUrls {
+			u.Feeds = append(u.Feeds, adminFeed{url, info.Tag, info.LastHash, webhookFor(user, info)})
+		}
+		sort.Slice(u.Feeds, func(i, j int) bool { return u.Feeds[i].URL < u.Feeds[j].URL })
+		page.Users = append(page.Users, u)
+	}
+	userSubscriptions.RUnlock()
+	sort.Slice(page.Users, func(i, j int) bool { return page.Users[i].Email < page.Users[j].Email })
+
+	subscription.RLock()
+	for url, info := range subscription.m {
+		u := adminURL{URL: url, LastUpdate: info.lastUpdate}
+		if info.error != nil {
+			u.Error = info.error.Error()
+		}
+		if info.feed != nil {
+			u.Items = len(info.feed.Items)
+		}
+		page.URLs = append(page.URLs, u)
+	}
+	subscription.RUnlock()
+	sort.Slice(page.URLs, func(i, j int) bool { return page.URLs[i].URL < page.URLs[j].URL })
+
+	return page
+}
+
+// handleAdmin serves the dashboard on GET and its forms on POST.
+func handleAdmin(config *emailConfig) http.HandlerFunc {
+	return adminAuth(config, true, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		var message string
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(adminCSRF)) != 1 {
+				http.Error(w, "invalid form", http.StatusForbidden)
+				return
+			}
+			message = adminAction(config, r.PostFormValue("action"),
+				strings.TrimSpace(r.PostFormValue("user")), strings.TrimSpace(r.PostFormValue("url")))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page := adminState(config)
+		page.Message = message
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := adminTemplate.Execute(w, page); err != nil {
+			log.Println("error admin template", err)
+		}
+	})
+}
+
+// adminAction runs one dashboard form and returns the message shown to the
+// admin.
+func adminAction(config *emailConfig, action, user, url string) string {
+	switch action {
+	case "add":
+		if user == "" || !validFeedURL(url) {
+			return "a user and an http(s) url are required"
+		}
+		userSubscriptions.Lock()
+		addSubscriptions(user, []string{url})
+		err := saveSubscriptions(config)
+		userSubscriptions.Unlock()
+		if err != nil {
+			return "error saving: " + err.Error()
+		}
+		return user + " subscribed to " + url
+	case "remove":
+		userSubscriptions.Lock()
+		removeSubscriptions(user, []string{url})
+		err := saveSubscriptions(config)
+		userSubscriptions.Unlock()
+		if err != nil {
+			return "error saving: " + err.Error()
+		}
+		return user + " unsubscribed from " + url
+	case "fetch":
+		feedURL, ok := normalizeURL(url)
+		if !ok {
+			return "an http(s) url is required"
+		}
+		url = feedURL
+		// unsubscribed urls would stay in every fetch cycle
+		var subscribed bool
+		userSubscriptions.RLock()
+		for _, userUrls := range userSubscriptions.m {
+			if _, ok := (*userUrls)[url]; ok {
+				subscribed = true
+				break
+			}
+		}
+		userSubscriptions.RUnlock()
+		if !subscribed {
+			return url + " is not subscribed by any user"
+		}
+
+		subscription.Lock()
+		if _, ok := subscription.m[url]; !ok {
+			subscription.m[url] = newURLInfo()
+		}
+		subscription.Unlock()
+
+		if err := fetchURLs([]string{url}); err != nil {
+			return "error fetching: " + err.Error()
+		}
+		return url + " fetched"
+	case "send":
+		userSubscriptions.RLock()
+		_, ok := userSubscriptions.m[user]
+		userSubscriptions.RUnlock()
+		if !ok {
+			return user + " is not subscribed"
+		}
+		if err := sendSubscription(config, user); err != nil {
+			return "error sending: " + err.Error()
+		}
+		return "new items of " + user + " are queued"
+	}
+	return "unknown action " + action
+}
+
+var adminTemplate = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>rss-email admin</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>rss-email admin</h1>
+{{if .Message}}<p><b>{{.Message}}</b></p>{{end}}
+
+<h2>Users</h2>
+<form method="post">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input type="hidden" name="action" value="add">
+<input name="user" placeholder="email"> <input name="url" placeholder="feed url" size="50">
+<button>subscribe</button>
+</form>
+{{range .Users}}
+{{$user := .Email}}
+<h3>{{.Email}}</h3>
+<p>delivery: {{.Delivery}}, pending in outbox: {{.Pending}}
+<form method="post">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<input type="hidden" name="action" value="send">
+<input type="hidden" name="user" value="{{.Email}}">
+<button>send digest now</button>
+</form></p>
+<table>
+<tr><th>feed</th><th>tag</th><th>last hash</th><th>webhook</th><th></th></tr>
+{{range .Feeds}}
+<tr><td>{{.URL}}</td><td>{{.Tag}}</td><td>{{.LastHash}}</td><td>{{.Webhook}}</td>
+<td><form method="post">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<input type="hidden" name="action" value="remove">
+<input type="hidden" name="user" value="{{$user}}">
+<input type="hidden" name="url" value="{{.URL}}">
+<button>remove</button>
+</form></td></tr>
+{{end}}
+</table>
+{{end}}
+
+<h2>Feeds</h2>
+<table>
+<tr><th>url</th><th>last update</th><th>items</th><th>error</th><th></th></tr>
+{{range .URLs}}
+<tr><td>{{.URL}}</td><td>{{if .LastUpdate.IsZero}}never{{else}}{{.LastUpdate.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{.Items}}</td><td>{{.Error}}</td>
+<td><form method="post">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<input type="hidden" name="action" value="fetch">
+<input type="hidden" name="url" value="{{.URL}}">
+<button>fetch now</button>
+</form></td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
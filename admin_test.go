@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_adminAuth(t *testing.T) {
+	config := &emailConfig{adminToken: "secret"}
+	handler := adminAuth(config, true, func(w http.ResponseWriter, r *http.Request) {})
+	api := adminAuth(config, false, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name string
+		set  func(r *http.Request)
+		want int
+		// the api doesn't take basic auth
+		wantAPI int
+	}{
+		{"none", func(r *http.Request) {}, http.StatusUnauthorized, http.StatusUnauthorized},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK, http.StatusUnauthorized},
+		{"basic wrong", func(r *http.Request) { r.SetBasicAuth("admin", "guess") }, http.StatusUnauthorized, http.StatusUnauthorized},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK, http.StatusOK},
+		{"bearer wrong", func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/admin/", nil)
+			tt.set(r)
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+
+			w = httptest.NewRecorder()
+			api(w, r)
+			if w.Code != tt.wantAPI {
+				t.Errorf("api status %d, want %d", w.Code, tt.wantAPI)
+			}
+		})
+	}
+}
+
+func Test_adminActionFetch(t *testing.T) {
+	keepState(t)
+	subscribeUser("a@example.com", []string{"https://a.example.com/feed"})
+
+	for _, url := range []string{"", "not a url", "ftp://a.example.com/feed", "https://b.example.com/feed"} {
+		adminAction(&emailConfig{}, "fetch", "", url)
+	}
+	if len(subscription.m) != 0 {
+		t.Errorf("fetch of invalid or unsubscribed urls added %d feeds", len(subscription.m))
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiSubscription is one feed of a user in API responses.
+type apiSubscription struct {
+	URL      string `json:"url"`
+	Tag      string `json:"tag,omitempty"`
+	LastHash string `json:"last_hash,omitempty"`
+	Webhook  string `json:"webhook,omitempty"`
+}
+
+type apiUser struct {
+	Email         string            `json:"email"`
+	Subscriptions []apiSubscription `json:"subscriptions"`
+}
+
+type apiFeed struct {
+	URL        string     `json:"url"`
+	LastUpdate *time.Time `json:"last_update,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Items      int        `json:"items"`
+}
+
+// apiURLs is the body of subscribe, add and remove requests.
+type apiURLs struct {
+	URLs []string `json:"urls"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, &apiError{msg})
+}
+
+// toAPIUser converts the subscriptions of user, caller must hold
+// userSubscriptions lock.
+func toAPIUser(user string, userSubscription *userSubscriptionType) *apiUser {
+	u := &apiUser{Email: user, Subscriptions: []apiSubscription{}}
+	for url, info := range *userSubscription {
+		u.Subscriptions = append(u.Subscriptions, apiSubscription{url, info.Tag, info.LastHash, webhookFor(user, info)})
+	}
+	sort.Slice(u.Subscriptions, func(i, j int) bool { return u.Subscriptions[i].URL < u.Subscriptions[j].URL })
+	return u
+}
+
+// handleAPI serves the admin API, authenticated by a bearer token so browsers
+// can't be tricked into calling it:
+//
+//	GET    /api/users                list users
+//	GET    /api/users/<email>        list the subscriptions of a user
+//	PUT    /api/users/<email>        subscribe, replacing the subscriptions
+//	DELETE /api/users/<email>        unsubscribe
+//	POST   /api/users/<email>/add    add subscriptions
+//	POST   /api/users/<email>/remove remove subscriptions
+//	GET    /api/feeds                status of every feed
+//	POST   /api/fetch                fetch every feed now
+//	POST   /api/send                 queue every user's digest now
+func handleAPI(config *emailConfig) http.HandlerFunc {
+	return adminAuth(config, false, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+
+		switch {
+		case len(parts) == 1 && parts[0] == "users" && r.Method == "GET":
+			apiListUsers(w)
+		case len(parts) == 2 && parts[0] == "users" && parts[1] != "":
+			apiUserCommand(w, r, config, parts[1], "")
+		case len(parts) == 3 && parts[0] == "users" && parts[1] != "" && r.Method == "POST":
+			apiUserCommand(w, r, config, parts[1], parts[2])
+		case len(parts) == 1 && parts[0] == "feeds" && r.Method == "GET":
+			apiListFeeds(w)
+		case len(parts) == 1 && parts[0] == "fetch" && r.Method == "POST":
+			apiFetch(w, config)
+		case len(parts) == 1 && parts[0] == "send" && r.Method == "POST":
+			apiSend(w, config)
+		default:
+			writeAPIError(w, http.StatusNotFound, "no such endpoint")
+		}
+	})
+}
+
+func apiListUsers(w http.ResponseWriter) {
+	userSubscriptions.RLock()
+	users := []string{}
+	for user := range userSubscriptions.m {
+		users = append(users, user)
+	}
+	userSubscriptions.RUnlock()
+
+	sort.Strings(users)
+	writeJSON(w, http.StatusOK, users)
+}
+
+// apiUserCommand runs command on user, the empty command is chosen by method.
+func apiUserCommand(w http.ResponseWriter, r *http.Request, config *emailConfig, user, command string) {
+	if command == "" {
+		switch r.Method {
+		case "GET":
+			command = "list"
+		case "PUT":
+			command = "subscribe"
+		case "DELETE":
+			command = "unsubscribe"
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+	}
+	switch command {
+	case "list", "subscribe", "add", "remove", "unsubscribe":
+	default:
+		writeAPIError(w, http.StatusNotFound, "no such endpoint")
+		return
+	}
+
+	var body apiURLs
+	if command == "subscribe" || command == "add" || command == "remove" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if len(body.URLs) == 0 {
+			writeAPIError(w, http.StatusBadRequest, "no urls")
+			return
+		}
+		for _, url := range body.URLs {
+			if !validFeedURL(url) {
+				writeAPIError(w, http.StatusBadRequest, "not a valid http(s) url: "+url)
+				return
+			}
+		}
+	}
+	commandsProcessed.WithLabelValues(command).Inc()
+
+	if command == "list" {
+		userSubscriptions.RLock()
+		defer userSubscriptions.RUnlock()
+
+		userSubscription, ok := userSubscriptions.m[user]
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, responseNotSubscribeBody)
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIUser(user, userSubscription))
+		return
+	}
+
+	userSubscriptions.Lock()
+	defer userSubscriptions.Unlock()
+
+	var userSubscription *userSubscriptionType
+	ok := true
+	switch command {
+	case "subscribe":
+		userSubscription = subscribeUser(user, body.URLs)
+	case "add":
+		userSubscription = addSubscriptions(user, body.URLs)
+	case "remove":
+		userSubscription, ok = removeSubscriptions(user, body.URLs)
+	case "unsubscribe":
+		ok = unsubscribeUser(user)
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, responseNotSubscribeBody)
+		return
+	}
+
+	if err := saveSubscriptions(config); err != nil {
+		log.Println("error save to disk", err)
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if command == "unsubscribe" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIUser(user, userSubscription))
+}
+
+func apiListFeeds(w http.ResponseWriter) {
+	subscription.RLock()
+	feeds := []apiFeed{}
+	for url, info := range subscription.m {
+		feed := apiFeed{URL: url}
+		if !info.lastUpdate.IsZero() {
+			lastUpdate := info.lastUpdate
+			feed.LastUpdate = &lastUpdate
+		}
+		if info.error != nil {
+			feed.Error = info.error.Error()
+		}
+		if info.feed != nil {
+			feed.Items = len(info.feed.Items)
+		}
+		feeds = append(feeds, feed)
+	}
+	subscription.RUnlock()
+
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].URL < feeds[j].URL })
+	writeJSON(w, http.StatusOK, feeds)
+}
+
+// apiFetch runs a fetchfeed cycle and answers once it's done, or with 409
+// while one is running.
+func apiFetch(w http.ResponseWriter, config *emailConfig) {
+	err := runFetchfeed(config)
+	if err == errFetchRunning {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiListFeeds(w)
+}
+
+// apiSend runs a sendemail cycle, the digests are delivered by the outbox.
+func apiSend(w http.ResponseWriter, config *emailConfig) {
+	jobs.start("sendemail")
+	err := sendSubscription(config)
+	jobs.finish("sendemail", err)
+
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"outbox": outbox.depth()})
+}
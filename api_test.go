@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func Test_apiFetchRunning(t *testing.T) {
+	keepState(t)
+	handler := handleAPI(&emailConfig{adminToken: "secret"})
+	fetch := func() int {
+		r := httptest.NewRequest("POST", "/api/fetch", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// a ticker's cycle is running
+	atomic.StoreInt32(&fetching, 1)
+	if code := fetch(); code != http.StatusConflict {
+		t.Errorf("fetch during a fetch status %d, want %d", code, http.StatusConflict)
+	}
+	atomic.StoreInt32(&fetching, 0)
+
+	if code := fetch(); code != http.StatusOK {
+		t.Errorf("fetch status %d, want %d", code, http.StatusOK)
+	}
+	if atomic.LoadInt32(&fetching) != 0 {
+		t.Error("fetch left the guard set")
+	}
+}
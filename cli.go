@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// commandUsage lists the offline administration commands, run instead of the
+// service when given after the flags.
+const commandUsage = `  users list                    list users and their subscription count
+  users set-delivery <email> <delivery> [<path>]
+                                deliver a user's digests by smtp, or to a maildir, mbox
+                                or imap folder path, default goes back to -delivery
+  subs list <email>             list the subscriptions of a user
+  subs add <email> <url>...     subscribe a user to urls
+  subs remove <email> <url>...  unsubscribe a user from urls
+  feed test <url>               fetch and parse a feed, print its items
+  render <email>                print the HTML of a user's next digest without sending it
+  send-test <email>             deliver a test email to an address right away
+`
+
+var errCommandUsage = errors.New("unknown command, see -h")
+
+// runCommand runs one offline administration command on the state files in
+// config.dataDir, e.g. "users list". Stop the service before changing
+// subscriptions, it would overwrite them on its next save.
+func runCommand(config *emailConfig, args []string, w io.Writer) error {
+	if err := userSubscriptions.restoreFromDisk(); err != nil {
+		return err
+	}
+
+	command := args[0]
+	if len(args) > 1 && (command == "users" || command == "subs" || command == "feed") {
+		command += " " + args[1]
+		args = args[1:]
+	}
+	args = args[1:]
+
+	switch {
+	case command == "users list" && len(args) == 0:
+		return listUsers(config, w)
+	case command == "users set-delivery" && (len(args) == 2 || len(args) == 3):
+		return setDelivery(config, args[0], args[1], args[2:], w)
+	case command == "subs list" && len(args) == 1:
+		return listSubscriptions(args[0], w)
+	case (command == "subs add" || command == "subs remove") && len(args) >= 2:
+		return changeSubscriptions(config, command == "subs add", args[0], args[1:], w)
+	case command == "feed test" && len(args) == 1:
+		return testFeed(args[0], w)
+	case command == "render" && len(args) == 1:
+		return renderDigest(config, args[0], w)
+	case command == "send-test" && len(args) == 1:
+		return sendTest(config, args[0], w)
+	}
+	return errCommandUsage
+}
+
+func listUsers(config *emailConfig, w io.Writer) error {
+	var users []string
+	for user := range userSubscriptions.m {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	for _, user := range users {
+		via, path := deliveryFor(config, user)
+		fmt.Fprintf(w, "%s\t%d feeds\t%s", user, len(*userSubscriptions.m[user]), strings.TrimSpace(via+" "+path))
+		if suspended := userSubscriptions.pref(user).Suspended; suspended != "" {
+			fmt.Fprintf(w, "\tsuspended: %s", suspended)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// setDelivery sets how the digests of user are delivered, path is required
+// but by smtp and default.
+func setDelivery(config *emailConfig, user, delivery string, path []string, w io.Writer) error {
+	if _, ok := userSubscriptions.m[user]; !ok {
+		return errors.New(responseNotSubscribeBody)
+	}
+	if delivery != "default" && !validDelivery(delivery) {
+		return fmt.Errorf("%q is not smtp, maildir, mbox, imap or default", delivery)
+	}
+	if needsPath := delivery != "default" && delivery != deliverSMTP; needsPath != (len(path) == 1) {
+		return errCommandUsage
+	}
+
+	pref := userSubscriptions.setPref(user)
+	pref.Delivery, pref.DeliveryPath = "", ""
+	// the new delivery gets another chance, see suspendFailed
+	pref.Suspended = ""
+	if delivery != "default" {
+		pref.Delivery = delivery
+	}
+	if len(path) == 1 {
+		pref.DeliveryPath = path[0]
+	}
+	if err := saveSubscriptions(config); err != nil {
+		return err
+	}
+	return listUsers(config, w)
+}
+
+func listSubscriptions(user string, w io.Writer) error {
+	userSubscription, ok := userSubscriptions.m[user]
+	if !ok {
+		return errors.New(responseNotSubscribeBody)
+	}
+
+	for _, s := range toAPIUser(user, userSubscription).Subscriptions {
+		fmt.Fprintf(w, "%s\t%s\n", s.URL, s.Tag)
+	}
+	return nil
+}
+
+func changeSubscriptions(config *emailConfig, add bool, user string, urls []string, w io.Writer) error {
+	for _, url := range urls {
+		if !validFeedURL(url) {
+			return fmt.Errorf("not a valid http(s) url: %s", url)
+		}
+	}
+
+	if add {
+		addSubscriptions(user, urls)
+	} else if _, ok := removeSubscriptions(user, urls); !ok {
+		return errors.New(responseNotSubscribeBody)
+	}
+	if err := saveSubscriptions(config); err != nil {
+		return err
+	}
+	return listSubscriptions(user, w)
+}
+
+func testFeed(url string, w io.Writer) error {
+	txt, err := httpGet(url)
+	if err != nil {
+		return err
+	}
+	feed, err := gofeed.NewParser().ParseString(txt)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s (%s, %d items)\n", feed.Title, feed.FeedType, len(feed.Items))
+	for _, item := range feed.Items {
+		date := "no date"
+		if d := itemDate(item); !d.IsZero() {
+			date = d.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", date, item.Title, item.Link)
+	}
+	return nil
+}
+
+// renderDigest fetches the feeds of user and prints the digests it would be
+// sent next, HTML or plain text, the read position is left alone.
+func renderDigest(config *emailConfig, user string, w io.Writer) error {
+	userSubscription, ok := userSubscriptions.m[user]
+	if !ok {
+		return errors.New(responseNotSubscribeBody)
+	}
+
+	var urls []string
+	for url := range *userSubscription {
+		subscription.m[url] = newURLInfo()
+		urls = append(urls, url)
+	}
+	if err := fetchURLs(urls); err != nil {
+		return err
+	}
+	for _, url := range urls {
+		if err := subscription.m[url].error; err != nil {
+			fmt.Fprintf(w, "<!-- %s: %v -->\n", url, err)
+		}
+	}
+
+	_, digests := userDigests(config, user, userSubscription)
+	var dests []string
+	for dest := range digests {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+
+	var rendered bool
+	for _, dest := range dests {
+		body, _, err := digestBody(config, digests[dest])
+		if err != nil {
+			return err
+		}
+		if body == "" {
+			continue
+		}
+		if len(dests) > 1 {
+			fmt.Fprintf(w, "<!-- %s -->\n", dest)
+		}
+		fmt.Fprintln(w, body)
+		rendered = true
+	}
+	if !rendered {
+		fmt.Fprintln(w, "<!-- nothing new -->")
+	}
+	return nil
+}
+
+// sendTest delivers a short message to to the way its digests go, without
+// the outbox, so configuration errors show right away.
+func sendTest(config *emailConfig, to string, w io.Writer) error {
+	if err := verifyConfig(config); err != nil {
+		return err
+	}
+
+	body, err := toQuotedPrintable("<div>This is a test email of rss-email, your delivery works.</div>")
+	if err != nil {
+		return err
+	}
+	data, err := composeMessage(config, to, "[rss-email] test", contentHTML, body)
+	if err != nil {
+		return err
+	}
+
+	via, path := deliveryFor(config, to)
+	deliverers := newDeliverers(config)
+	defer func() {
+		for _, d := range deliverers {
+			d.close()
+		}
+	}()
+
+	d, ok := deliverers[via]
+	if !ok {
+		return fmt.Errorf("unknown delivery %q of %s", via, to)
+	}
+	msg := &outboxMessage{ID: newOutboxID(), To: to, Via: via, Path: path, Data: data, Created: time.Now()}
+	if err := d.deliver(msg); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "delivered to %s by %s\n", to, strings.TrimSpace(via+" "+path))
+	return nil
+}
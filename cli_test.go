@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_runCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rss-email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setDataDir(dir)
+	defer setDataDir("/rss-email")
+
+	config := &emailConfig{delivery: deliverSMTP}
+	run := func(args ...string) (string, error) {
+		userSubscriptions = newUserSubscriptions()
+		var out bytes.Buffer
+		err := runCommand(config, args, &out)
+		return out.String(), err
+	}
+
+	if _, err := run("subs", "add", "a@example.com", "https://a.example.com/feed", "https://b.example.com/feed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("subs", "remove", "a@example.com", "https://a.example.com/feed"); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := run("users", "list")
+	if err != nil || out != "a@example.com\t1 feeds\tsmtp\n" {
+		t.Errorf("users list = %q, %v", out, err)
+	}
+	out, err = run("subs", "list", "a@example.com")
+	if err != nil || out != "https://b.example.com/feed\t\n" {
+		t.Errorf("subs list = %q, %v", out, err)
+	}
+
+	out, err = run("users", "set-delivery", "a@example.com", "maildir", "/var/mail/a")
+	if err != nil || out != "a@example.com\t1 feeds\tmaildir /var/mail/a\n" {
+		t.Errorf("users set-delivery = %q, %v", out, err)
+	}
+	if _, err := run("users", "set-delivery", "a@example.com", "mbox"); err != errCommandUsage {
+		t.Errorf("set-delivery without path error %v", err)
+	}
+	out, err = run("users", "set-delivery", "a@example.com", "default")
+	if err != nil || out != "a@example.com\t1 feeds\tsmtp\n" {
+		t.Errorf("users set-delivery default = %q, %v", out, err)
+	}
+
+	if _, err := run("subs", "add", "a@example.com", "not-a-url"); err == nil {
+		t.Error("invalid url accepted")
+	}
+	if _, err := run("users"); err != errCommandUsage {
+		t.Errorf("incomplete command error %v", err)
+	}
+}
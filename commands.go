@@ -0,0 +1,99 @@
+package main
+
+import (
+	neturl "net/url"
+	"strings"
+)
+
+// The commands below change userSubscriptions the same way whether they come
+// by email, see processMessage, or through the admin API. Callers must hold
+// userSubscriptions lock and save it afterwards.
+
+// normalizeURL returns str as the feed url it is subscribed under. Urls
+// without a scheme, which httpRegex accepts in emails, get http://, the feed
+// may redirect. ok is false when str is not an http(s) url.
+func normalizeURL(str string) (url string, ok bool) {
+	str = strings.TrimSpace(str)
+	bare := !strings.Contains(str, "://")
+	if bare {
+		str = "http://" + str
+	}
+	u, err := neturl.Parse(str)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	// like httpRegex, a bare host needs a domain
+	if bare && !strings.Contains(u.Hostname(), ".") {
+		return "", false
+	}
+	return u.String(), true
+}
+
+func validFeedURL(str string) bool {
+	_, ok := normalizeURL(str)
+	return ok
+}
+
+// normalizeURLs normalizes urls, dropping invalid ones.
+func normalizeURLs(urls []string) []string {
+	var res []string
+	for _, url := range urls {
+		if url, ok := normalizeURL(url); ok {
+			res = append(res, url)
+		}
+	}
+	return res
+}
+
+// subscribeUser replaces the subscriptions of user with urls.
+func subscribeUser(user string, urls []string) *userSubscriptionType {
+	userSubscription := newUserSubscription()
+	for _, url := range normalizeURLs(urls) {
+		(*userSubscription)[url] = newUserURLInfo()
+	}
+	userSubscriptions.m[user] = userSubscription
+	return userSubscription
+}
+
+// addSubscriptions subscribes user to urls, keeping the current
+// subscriptions and their state.
+func addSubscriptions(user string, urls []string) *userSubscriptionType {
+	userSubscription, ok := userSubscriptions.m[user]
+	if !ok {
+		userSubscription = newUserSubscription()
+		userSubscriptions.m[user] = userSubscription
+	}
+	for _, url := range normalizeURLs(urls) {
+		if _, ok := (*userSubscription)[url]; !ok {
+			(*userSubscription)[url] = newUserURLInfo()
+		}
+	}
+	return userSubscription
+}
+
+// removeSubscriptions unsubscribes user from urls, ok is false when user is
+// not subscribed at all.
+func removeSubscriptions(user string, urls []string) (userSubscription *userSubscriptionType, ok bool) {
+	userSubscription, ok = userSubscriptions.m[user]
+	if !ok {
+		return nil, false
+	}
+	for _, url := range urls {
+		// the url as given too, subscriptions saved before normalizeURL
+		// may lack the scheme
+		delete(*userSubscription, url)
+		if url, ok := normalizeURL(url); ok {
+			delete(*userSubscription, url)
+		}
+	}
+	return userSubscription, true
+}
+
+// unsubscribeUser forgets user with its preferences, it returns false when
+// user was not subscribed.
+func unsubscribeUser(user string) bool {
+	_, ok := userSubscriptions.m[user]
+	delete(userSubscriptions.m, user)
+	delete(userSubscriptions.prefs, user)
+	return ok
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func Test_subscriptionCommands(t *testing.T) {
+	keepState(t)
+	urls := func(user string) []string {
+		var got []string
+		for url := range *userSubscriptions.m[user] {
+			got = append(got, url)
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	subscribeUser("a@example.com", []string{"https://a.example.com/feed"})
+	(*userSubscriptions.m["a@example.com"])["https://a.example.com/feed"].LastHash = "hash"
+
+	addSubscriptions("a@example.com", []string{"https://a.example.com/feed", "https://b.example.com/feed"})
+	if got := urls("a@example.com"); !reflect.DeepEqual(got, []string{"https://a.example.com/feed", "https://b.example.com/feed"}) {
+		t.Errorf("after add %q", got)
+	}
+	if hash := (*userSubscriptions.m["a@example.com"])["https://a.example.com/feed"].LastHash; hash != "hash" {
+		t.Errorf("add reset the state of a subscribed feed, LastHash %q", hash)
+	}
+
+	if _, ok := removeSubscriptions("a@example.com", []string{"https://a.example.com/feed"}); !ok {
+		t.Error("remove of a subscribed user failed")
+	}
+	if got := urls("a@example.com"); !reflect.DeepEqual(got, []string{"https://b.example.com/feed"}) {
+		t.Errorf("after remove %q", got)
+	}
+	if _, ok := removeSubscriptions("b@example.com", []string{"https://a.example.com/feed"}); ok {
+		t.Error("remove of an unknown user succeeded")
+	}
+
+	// urls without a scheme are subscribed as http, whichever way they come
+	addSubscriptions("a@example.com", []string{"c.example.com/feed", "not-a-url"})
+	if got := urls("a@example.com"); !reflect.DeepEqual(got, []string{"http://c.example.com/feed", "https://b.example.com/feed"}) {
+		t.Errorf("after add without scheme %q", got)
+	}
+	removeSubscriptions("a@example.com", []string{"c.example.com/feed"})
+	if got := urls("a@example.com"); !reflect.DeepEqual(got, []string{"https://b.example.com/feed"}) {
+		t.Errorf("after remove without scheme %q", got)
+	}
+
+	if !unsubscribeUser("a@example.com") || unsubscribeUser("a@example.com") {
+		t.Error("unsubscribe should succeed once")
+	}
+}
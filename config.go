@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// settings whose value can also be read from a file named by the flag with
+// a File suffix, e.g. -passwordFile, keeping it out of ps and docker inspect
+var secretSettings = []string{"password", "webhookSecret", "adminToken"}
+
+// the prefix of environment variables overriding settings
+const envPrefix = "RSS_EMAIL_"
+
+// envName returns the environment variable of a setting, e.g. smtpServer is
+// RSS_EMAIL_SMTP_SERVER.
+func envName(name string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(runes[i-1]) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// loadConfig completes the settings parsed from the command line of fs. Every
+// flag is a setting, taken in order from the command line, the environment,
+// the config file named by -config and the flag default. Secret settings are
+// then read from their files if given, unless on the command line.
+func loadConfig(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	configFile := fs.Lookup("config").Value.String()
+	if v, ok := os.LookupEnv(envName("config")); ok && !explicit["config"] {
+		configFile = v
+	}
+	if configFile != "" {
+		if err := applyConfigFile(fs, configFile, explicit); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || f.Name == "config" || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), e)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range secretSettings {
+		file := fs.Lookup(name + "File").Value.String()
+		if file == "" || explicit[name] {
+			continue
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("%sFile: %v", name, err)
+		}
+		if err := fs.Set(name, strings.TrimRight(string(b), "\r\n")); err != nil {
+			return fmt.Errorf("%sFile: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyConfigFile sets the settings of a YAML file of flag names to values,
+// except those given on the command line. Lists are joined by commas.
+func applyConfigFile(fs *flag.FlagSet, file string, explicit map[string]bool) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	settings := make(map[string]interface{})
+	if err := yaml.Unmarshal(b, &settings); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	// sorted for a stable first error
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", file, name)
+		}
+		if explicit[name] {
+			continue
+		}
+
+		var value string
+		switch v := settings[name].(type) {
+		case nil:
+			continue
+		case []interface{}:
+			var list []string
+			for _, e := range v {
+				list = append(list, fmt.Sprint(e))
+			}
+			value = strings.Join(list, ",")
+		case map[interface{}]interface{}:
+			return fmt.Errorf("%s: %s: want a value or a list", file, name)
+		default:
+			value = fmt.Sprint(v)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %v", file, name, err)
+		}
+	}
+
+	return nil
+}
+
+// setDataDir keeps every state file of rss-email in dir.
+func setDataDir(dir string) {
+	savedFilePath = path.Join(dir, "user")
+	preferencesFilePath = path.Join(dir, "preferences")
+	outboxFilePath = path.Join(dir, "outbox")
+	checkpointFilePath = path.Join(dir, "imap")
+	pop3SeenFilePath = path.Join(dir, "pop3")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_envName(t *testing.T) {
+	tests := map[string]string{
+		"email":              "RSS_EMAIL_EMAIL",
+		"smtpServer":         "RSS_EMAIL_SMTP_SERVER",
+		"smtpTLS":            "RSS_EMAIL_SMTP_TLS",
+		"pop3Server":         "RSS_EMAIL_POP3_SERVER",
+		"publicURL":          "RSS_EMAIL_PUBLIC_URL",
+		"insecureSkipVerify": "RSS_EMAIL_INSECURE_SKIP_VERIFY",
+	}
+	for name, want := range tests {
+		if got := envName(name); got != want {
+			t.Errorf("envName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func Test_loadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rss-email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.yaml")
+	passwordFile := filepath.Join(dir, "password")
+	ioutil.WriteFile(configFile, []byte(`
+email: file@example.com
+smtpServer: file.example.com
+username: file
+mailboxes: [INBOX, Feeds]
+fetchfeedInterval: 1h
+passwordFile: `+passwordFile+`
+`), 0600)
+	ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600)
+
+	os.Setenv("RSS_EMAIL_SMTP_SERVER", "env.example.com")
+	os.Setenv("RSS_EMAIL_USERNAME", "env")
+	defer os.Unsetenv("RSS_EMAIL_SMTP_SERVER")
+	defer os.Unsetenv("RSS_EMAIL_USERNAME")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	for _, name := range secretSettings {
+		fs.String(name+"File", "", "")
+		fs.String(name, "", "")
+	}
+	email := fs.String("email", "", "")
+	smtpServer := fs.String("smtpServer", "", "")
+	username := fs.String("username", "", "")
+	mailboxes := fs.String("mailboxes", "INBOX", "")
+	fetchfeedInterval := fs.Duration("fetchfeedInterval", time.Minute, "")
+
+	if err := fs.Parse([]string{"-config", configFile, "-username", "flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	// flags over environment over file
+	if *email != "file@example.com" || *smtpServer != "env.example.com" || *username != "flag" {
+		t.Errorf("email %q smtpServer %q username %q", *email, *smtpServer, *username)
+	}
+	if *mailboxes != "INBOX,Feeds" || *fetchfeedInterval != time.Hour {
+		t.Errorf("mailboxes %q fetchfeedInterval %v", *mailboxes, *fetchfeedInterval)
+	}
+	if password := fs.Lookup("password").Value.String(); password != "secret" {
+		t.Errorf("password %q from passwordFile", password)
+	}
+
+	// the secret on the command line wins over its file
+	if err := fs.Parse([]string{"-config", configFile, "-password", "flag secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+	if password := fs.Lookup("password").Value.String(); password != "flag secret" {
+		t.Errorf("password %q, want the one of -password", password)
+	}
+
+	ioutil.WriteFile(configFile, []byte("smtpServr: typo.example.com\n"), 0600)
+	if err := loadConfig(fs); err == nil {
+		t.Error("unknown setting accepted")
+	}
+}
+
+func Test_verifyConfig(t *testing.T) {
+	base := []string{"-email", "rss@example.com", "-username", "rss", "-password", "secret"}
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"-imapServer", "imap.example.com", "-smtpServer", "smtp.example.com"}, ""},
+		{[]string{"-smtpServer", "smtp.example.com"}, "imapServer: missing, required with inbox imap"},
+		{[]string{"-inbox", "pop3", "-pop3Server", "pop.example.com", "-smtpServer", "smtp.example.com"}, ""},
+		{[]string{"-imapServer", "imap.example.com", "-delivery", "imap"}, ""},
+		{[]string{"-inbox", "pop3", "-pop3Server", "pop.example.com", "-delivery", "imap"}, "imapServer: missing, required with delivery imap"},
+		{[]string{"-inbox", "pop3", "-pop3Server", "pop.example.com", "-delivery", "imap", "-imapServer", "imap.example.com"}, ""},
+	}
+	for _, tt := range tests {
+		config, _, err := parseConfig(append(append([]string(nil), base...), tt.args...), flag.ContinueOnError)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := verifyConfig(config); err != nil {
+			got = err.Error()
+		}
+		if got != tt.wantErr {
+			t.Errorf("verifyConfig(%q) = %q, want %q", tt.args, got, tt.wantErr)
+		}
+	}
+}
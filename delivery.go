@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// the ways a composed message reaches its recipient
+const (
+	// through the SMTP relay
+	deliverSMTP = "smtp"
+	// written into a local Maildir directory
+	deliverMaildir = "maildir"
+	// appended to a local mbox file
+	deliverMbox = "mbox"
+	// appended to a folder on the imap server fetchemail logs into
+	deliverIMAP = "imap"
+	// POSTed as JSON, in addition to the digest, see queueWebhooks
+	deliverWebhook = "webhook"
+)
+
+func validDelivery(delivery string) bool {
+	switch delivery {
+	case deliverSMTP, deliverMaildir, deliverMbox, deliverIMAP:
+		return true
+	}
+	return false
+}
+
+// deliverer hands one queued message over to its destination. Messages are
+// delivered from the outbox, so every deliverer gets the same retries.
+type deliverer interface {
+	deliver(msg *outboxMessage) error
+	// close releases connections kept for the rest of the drain
+	close()
+}
+
+// permanentError marks a failure that retrying won't fix.
+type permanentError struct {
+	error
+}
+
+func (err permanentError) Unwrap() error {
+	return err.error
+}
+
+func isPermanentError(err error) bool {
+	var perm permanentError
+	return errors.As(err, &perm) || isPermanentSMTPError(err)
+}
+
+// deliveryFor returns how messages to user are delivered and where to, the
+// user's preference taking precedence over the deployment's.
+func deliveryFor(config *emailConfig, user string) (string, string) {
+	pref := userSubscriptions.pref(user)
+	if pref.Delivery != "" {
+		return pref.Delivery, pref.DeliveryPath
+	}
+
+	switch config.delivery {
+	case deliverMaildir:
+		return deliverMaildir, config.maildir
+	case deliverMbox:
+		return deliverMbox, config.mbox
+	case deliverIMAP:
+		return deliverIMAP, config.appendFolder
+	}
+	return deliverSMTP, ""
+}
+
+// newDeliverers returns a deliverer for each delivery, connections are opened
+// on first use.
+func newDeliverers(config *emailConfig) map[string]deliverer {
+	return map[string]deliverer{
+		deliverSMTP:    &smtpDeliverer{newSMTPSession(config)},
+		deliverMaildir: &maildirDeliverer{},
+		deliverMbox:    &mboxDeliverer{},
+		deliverIMAP:    &imapDeliverer{config: config},
+		deliverWebhook: &webhookDeliverer{config},
+	}
+}
+
+type smtpDeliverer struct {
+	session *smtpSession
+}
+
+func (d *smtpDeliverer) deliver(msg *outboxMessage) error {
+	return d.session.send(msg.To, msg.Data)
+}
+
+func (d *smtpDeliverer) close() {
+	d.session.close()
+}
+
+// imapDeliverer APPENDs messages into the folder msg.Path, creating it when
+// missing. Folder levels are separated by "/" whatever the server uses.
+type imapDeliverer struct {
+	config    *emailConfig
+	client    *client.Client
+	delimiter string
+	created   map[string]bool
+}
+
+func (d *imapDeliverer) dial() error {
+	c, err := dialIMAP(d.config)
+	if err != nil {
+		return err
+	}
+	if err := c.Login(d.config.username, d.config.password); err != nil {
+		c.Logout()
+		return err
+	}
+
+	// learn the hierarchy delimiter, LIST "" "" answers with a single line
+	ch := make(chan *imap.MailboxInfo, 10)
+	if err := c.List("", "", ch); err != nil {
+		c.Logout()
+		return err
+	}
+	d.delimiter = "/"
+	for info := range ch {
+		if info.Delimiter != "" {
+			d.delimiter = info.Delimiter
+		}
+	}
+
+	d.client = c
+	d.created = make(map[string]bool)
+	return nil
+}
+
+func (d *imapDeliverer) deliver(msg *outboxMessage) error {
+	if msg.Path == "" {
+		return permanentError{errors.New("no imap folder configured")}
+	}
+
+	if d.client == nil {
+		if err := d.dial(); err != nil {
+			return err
+		}
+	}
+
+	folder := strings.ReplaceAll(msg.Path, "/", d.delimiter)
+	if !d.created[folder] {
+		// fails harmlessly when the folder already exists
+		d.client.Create(folder)
+		d.created[folder] = true
+	}
+
+	if err := d.client.Append(folder, nil, time.Now(), bytes.NewBuffer(msg.Data)); err != nil {
+		// the connection may be gone, dial again next time
+		d.close()
+		return err
+	}
+
+	log.Printf("one email appended to %s", folder)
+
+	return nil
+}
+
+func (d *imapDeliverer) close() {
+	if d.client == nil {
+		return
+	}
+	d.client.Logout()
+	d.client = nil
+}
+
+// maildirDeliverer writes messages into msg.Path following the Maildir
+// conventions: written to tmp, then renamed into new.
+type maildirDeliverer struct {
+	count int
+}
+
+func (d *maildirDeliverer) deliver(msg *outboxMessage) error {
+	if msg.Path == "" {
+		return permanentError{errors.New("no maildir configured")}
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(msg.Path, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	d.count++
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", time.Now().Unix(), time.Now().Nanosecond()/1000, os.Getpid(), d.count, hostname)
+
+	tmp := filepath.Join(msg.Path, "tmp", name)
+	if err := writeFileSync(tmp, msg.Data); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(msg.Path, "new", name))
+}
+
+func (d *maildirDeliverer) close() {}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mboxDeliverer appends messages to the mbox file msg.Path, in the mboxrd
+// format.
+type mboxDeliverer struct{}
+
+// serializes appends from this process, other writers are not expected
+var mboxMutex sync.Mutex
+
+func (d *mboxDeliverer) deliver(msg *outboxMessage) error {
+	if msg.Path == "" {
+		return permanentError{errors.New("no mbox configured")}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(msg.Path), 0700); err != nil {
+		return err
+	}
+
+	mboxMutex.Lock()
+	defer mboxMutex.Unlock()
+
+	f, err := os.OpenFile(msg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(toMbox(msg.Data, time.Now())); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (d *mboxDeliverer) close() {}
+
+// toMbox converts an RFC 5322 message to one mboxrd entry.
+func toMbox(data []byte, date time.Time) []byte {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "From MAILER-DAEMON %s\n", date.UTC().Format(time.ANSIC))
+
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			out.WriteByte('>')
+		}
+		out.Write(line)
+	}
+
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	out.WriteByte('\n')
+
+	return out.Bytes()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_toMbox(t *testing.T) {
+	date := time.Date(2020, 4, 23, 8, 0, 0, 0, time.UTC)
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"Subject: hi\r\n\r\nbody\r\n", "From MAILER-DAEMON Thu Apr 23 08:00:00 2020\nSubject: hi\n\nbody\n\n"},
+		{"Subject: hi\r\n\r\nFrom here\r\n>From there", "From MAILER-DAEMON Thu Apr 23 08:00:00 2020\nSubject: hi\n\n>From here\n>>From there\n\n"},
+	}
+	for _, c := range cases {
+		if got := string(toMbox([]byte(c.in), date)); got != c.want {
+			t.Errorf("toMbox(%q) == %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func Test_maildirDeliverer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &maildirDeliverer{}
+	for i := 0; i < 2; i++ {
+		if err := d.deliver(&outboxMessage{Path: dir, Data: []byte("Subject: hi\r\n\r\n")}); err != nil {
+			t.Fatalf("deliver error %q", err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("maildir new contains %d messages, want 2", len(files))
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "tmp", "*")); len(tmp) != 0 {
+		t.Errorf("maildir tmp not empty: %q", tmp)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// saveSubscriptions saves userSubscriptions, except in dry run where every
+// change stays in memory. Callers hold userSubscriptions lock.
+func saveSubscriptions(config *emailConfig) error {
+	if config.dryRun {
+		log.Println("dry run: user info not saved")
+		return nil
+	}
+	return userSubscriptions.saveToDisk()
+}
+
+// queueMessage leaves msg to the outbox. In dry run it's written to
+// config.dryRunDir instead and never delivered, so the feed state it commits
+// stays where it is.
+func queueMessage(config *emailConfig, msg *outboxMessage) error {
+	if !config.dryRun {
+		return outbox.enqueue(msg)
+	}
+
+	if err := os.MkdirAll(config.dryRunDir, 0700); err != nil {
+		return err
+	}
+
+	msg.ID = newOutboxID()
+	ext := ".eml"
+	if msg.Via == deliverWebhook {
+		ext = ".json"
+	}
+	name := filepath.Join(config.dryRunDir, time.Now().Format("20060102-150405")+"-"+msg.ID+ext)
+	if err := writeFileSync(name, msg.Data); err != nil {
+		return err
+	}
+
+	subject := msg.Path
+	if parsed, err := mail.ReadMessage(bytes.NewReader(msg.Data)); err == nil {
+		subject = parsed.Header.Get("Subject")
+	}
+	log.Printf("dry run: %s to %s by %s written to %s", subject, msg.To, msg.Via, name)
+	return nil
+}
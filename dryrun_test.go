@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_queueMessageDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rss-email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &emailConfig{from: "rss@example.com", dryRun: true, dryRunDir: filepath.Join(dir, "out")}
+	data, err := composeMessage(config, "a@example.com", feedSubject, contentHTML, "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &outboxMessage{To: "a@example.com", Via: deliverSMTP, Data: data, Commits: map[string]string{"https://a.example.com/feed": "hash"}}
+	if err := queueMessage(config, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if outbox.depth() != 0 {
+		t.Errorf("dry run queued %d messages", outbox.depth())
+	}
+	files, err := filepath.Glob(filepath.Join(config.dryRunDir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("written files %q, %v", files, err)
+	}
+	written, _ := ioutil.ReadFile(files[0])
+	if string(written) != string(data) {
+		t.Errorf("written message differs from the composed one")
+	}
+}
+
+func Test_drainDryRun(t *testing.T) {
+	dir := keepState(t)
+
+	subscribeUser("a@example.com", []string{"https://a.example.com/feed"})
+	info := (*userSubscriptions.m["a@example.com"])["https://a.example.com/feed"]
+	info.LastHash = "old"
+
+	// as restored from the outbox of a real run
+	maildir := filepath.Join(dir, "maildir")
+	outbox.Pending = append(outbox.Pending, &outboxMessage{
+		ID: newOutboxID(), To: "a@example.com", Via: deliverMaildir, Path: maildir,
+		Data: []byte("Subject: hi\r\n\r\n"), Commits: map[string]string{"https://a.example.com/feed": "new"},
+	})
+
+	config := &emailConfig{dryRun: true, dryRunDir: filepath.Join(dir, "out")}
+	if err := outbox.drain(config); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(maildir, "new", "*")); len(files) != 0 {
+		t.Errorf("dry run delivered %q", files)
+	}
+	if outbox.depth() != 1 || info.LastHash != "old" {
+		t.Errorf("dry run left %d messages and LastHash %q, want 1 and old", outbox.depth(), info.LastHash)
+	}
+
+	if err := commitAccepted(config, outbox.Pending); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(savedFilePath); !os.IsNotExist(err) {
+		t.Errorf("dry run saved user info, %v", err)
+	}
+}
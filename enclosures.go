@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	neturl "net/url"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// enclosures attached to one digest at most
+const maxAttachments = 10
+
+// functions of the digest templates
+var templateFuncs = template.FuncMap{
+	"byteSize": byteSize,
+	"duration": itemDuration,
+}
+
+// attachment is an enclosure attached to a digest.
+type attachment struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// byteSize formats the length of an enclosure, e.g. "12.3 MB", it's empty if
+// unknown.
+func byteSize(length string) string {
+	n, err := strconv.ParseFloat(length, 64)
+	if err != nil || n <= 0 {
+		return ""
+	}
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return strconv.FormatFloat(math.Round(n*10)/10, 'f', -1, 64) + " " + units[i]
+}
+
+// itemDuration returns the itunes duration of item as h:mm:ss or mm:ss, it's
+// empty if unknown.
+func itemDuration(item *gofeed.Item) string {
+	if item.ITunesExt == nil {
+		return ""
+	}
+	duration := strings.TrimSpace(item.ITunesExt.Duration)
+	seconds, err := strconv.Atoi(duration)
+	if err != nil || seconds <= 0 {
+		// already h:mm:ss or mm:ss
+		return duration
+	}
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// digestAttachments downloads the enclosures of the feeds of param attaching
+// them, the ones larger than config.attachMaxSize or beyond
+// config.attachMaxTotal are left as links. Callers must not hold
+// userSubscriptions lock or subscription lock meanwhile. Dry run downloads
+// nothing.
+func digestAttachments(config *emailConfig, param *bodyParam) []*attachment {
+	if config.dryRun {
+		return nil
+	}
+
+	var files []*attachment
+	total := 0
+	for _, feed := range param.Feeds {
+		if !feed.attach {
+			continue
+		}
+		for _, item := range feed.Items {
+			for _, enclosure := range item.Enclosures {
+				if len(files) >= maxAttachments || !remoteURL(enclosure.URL) {
+					continue
+				}
+				// skip the ones known to be too large without downloading
+				max := config.attachMaxSize * 1024
+				if left := config.attachMaxTotal*1024 - total; left < max {
+					max = left
+				}
+				if max <= 0 {
+					continue
+				}
+				if n, err := strconv.Atoi(enclosure.Length); err == nil && n > max {
+					continue
+				}
+
+				data, contentType, err := downloadFile(config, enclosure.URL, max)
+				if err != nil {
+					log.Printf("enclosure not attached: %v", err)
+					continue
+				}
+				files = append(files, &attachment{
+					name:        enclosureName(enclosure.URL),
+					contentType: attachmentType(enclosure.Type, contentType),
+					data:        data,
+				})
+				total += len(data)
+			}
+		}
+	}
+	return files
+}
+
+// attachmentType returns the first valid of the media types of an enclosure,
+// the feed's then the server's. Both come from elsewhere and end up in a
+// header, so anything else is application/octet-stream.
+func attachmentType(types ...string) string {
+	for _, t := range types {
+		mediaType, params, err := mime.ParseMediaType(t)
+		if err != nil {
+			continue
+		}
+		if formatted := mime.FormatMediaType(mediaType, params); formatted != "" {
+			return formatted
+		}
+	}
+	return "application/octet-stream"
+}
+
+// enclosureName returns the file name of an enclosure, the last element of
+// its url path.
+func enclosureName(url string) string {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return "enclosure"
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "enclosure"
+	}
+	return name
+}
+
+// mixedBody returns a multipart/mixed body of body, encoded as composeMessage
+// would for contentType, followed by files, and its content type.
+func mixedBody(body, contentType string, files []*attachment) (string, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	h := textproto.MIMEHeader{}
+	if strings.HasPrefix(contentType, "multipart/") {
+		h.Set("Content-Type", contentType)
+	} else {
+		h.Set("Content-Type", contentType+`; charset="UTF-8"`)
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+	}
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := io.WriteString(part, body); err != nil {
+		return "", "", err
+	}
+
+	for _, file := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", file.contentType)
+		h.Set("Content-Transfer-Encoding", "base64")
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": file.name})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+		h.Set("Content-Disposition", disposition)
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return "", "", err
+		}
+		if err := writeBase64(part, file.data); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return buf.String(), `multipart/mixed; boundary="` + w.Boundary() + `"`, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/extensions"
+)
+
+func Test_byteSize(t *testing.T) {
+	tests := map[string]string{
+		"":           "",
+		"0":          "",
+		"abc":        "",
+		"512":        "512 B",
+		"1536":       "1.5 KB",
+		"12897484":   "12.3 MB",
+		"5368709120": "5 GB",
+	}
+	for length, want := range tests {
+		if got := byteSize(length); got != want {
+			t.Errorf("byteSize(%q) = %q, want %q", length, got, want)
+		}
+	}
+}
+
+func Test_itemDuration(t *testing.T) {
+	tests := map[string]string{
+		"":        "",
+		"95":      "1:35",
+		"3723":    "1:02:03",
+		"1:02:03": "1:02:03",
+	}
+	for duration, want := range tests {
+		item := &gofeed.Item{ITunesExt: &ext.ITunesItemExtension{Duration: duration}}
+		if got := itemDuration(item); got != want {
+			t.Errorf("itemDuration(%q) = %q, want %q", duration, got, want)
+		}
+	}
+	if got := itemDuration(&gofeed.Item{}); got != "" {
+		t.Errorf("itemDuration without itunes = %q", got)
+	}
+}
+
+func Test_digestAttachments(t *testing.T) {
+	pdf := []byte("%PDF-1.4 tiny")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pdf)
+	}))
+	defer ts.Close()
+
+	published := time.Date(2020, 4, 23, 10, 0, 0, 0, time.UTC)
+	item := &gofeed.Item{
+		Title:           "Episode",
+		Link:            "https://pod.example.com/1",
+		PublishedParsed: &published,
+		ITunesExt:       &ext.ITunesItemExtension{Duration: "3723"},
+		Enclosures: []*gofeed.Enclosure{
+			{URL: ts.URL + "/notes.pdf", Type: "application/pdf", Length: "13"},
+			{URL: ts.URL + "/episode.mp3", Type: "audio/mpeg", Length: "12897484"},
+			{URL: ts.URL + "/notes.bin", Type: "text/plain\r\nBcc: victim@example.com", Length: "13"},
+		},
+	}
+	feed := &digestFeed{Feed: &gofeed.Feed{Title: "Pod", Items: []*gofeed.Item{item}}}
+	param := &bodyParam{Feeds: []*digestFeed{feed}}
+	sortDigest(param, defaultSort)
+	config := &emailConfig{from: "rss@example.com", attachMaxSize: 1024, attachMaxTotal: 8192, allowPrivate: []string{"127.0.0.1"}}
+
+	templateCache.reset()
+	got, err := parsefeed(config, "full", param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<a href="` + ts.URL + `/episode.mp3">audio/mpeg, 12.3 MB, 1:02:03</a>`; !strings.Contains(got, want) {
+		t.Errorf("digest lacks %q", want)
+	}
+
+	if files := digestAttachments(config, param); len(files) != 0 {
+		t.Errorf("%d attachments without opting in", len(files))
+	}
+	feed.attach = true
+	dryRun := *config
+	dryRun.dryRun = true
+	if files := digestAttachments(&dryRun, param); len(files) != 0 {
+		t.Errorf("%d attachments in dry run", len(files))
+	}
+	files := digestAttachments(config, param)
+	if len(files) != 2 || files[0].name != "notes.pdf" || !bytes.Equal(files[0].data, pdf) {
+		t.Fatalf("attachments %v, want notes.pdf and notes.bin", files)
+	}
+	// a type header injection is dropped for the server's
+	if files[1].contentType != "application/pdf" {
+		t.Errorf("notes.bin content type %q", files[1].contentType)
+	}
+	if got := attachmentType("text/plain\r\nBcc: victim@example.com", ""); got != "application/octet-stream" {
+		t.Errorf("attachmentType of invalid types = %q", got)
+	}
+
+	body, contentType, err := mixedBody("<p>digest</p>", contentHTML, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := composeMessage(config, "a@example.com", feedSubject, contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("content type %q, %v", msg.Header.Get("Content-Type"), err)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	if _, err := r.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	part, err := r.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.FileName() != "notes.pdf" || part.Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("attachment header %v", part.Header)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// the number of most recent items a personal feed carries
+const personalFeedItems = 100
+
+// newFeedToken returns a random token naming a user's personal feed.
+func newFeedToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// feedToken returns the personal feed token of user, creating it the first
+// time. Caller must hold userSubscriptions lock.
+func feedToken(user string) string {
+	pref := userSubscriptions.setPref(user)
+	if pref.Token == "" {
+		pref.Token = newFeedToken()
+	}
+	return pref.Token
+}
+
+// personalFeedLinks returns the html listing user's personal feeds, empty
+// when the http server is not reachable from outside. Caller must hold
+// userSubscriptions lock.
+func personalFeedLinks(config *emailConfig, user string) string {
+	if config.publicURL == "" {
+		return ""
+	}
+
+	base := strings.TrimSuffix(config.publicURL, "/") + "/u/" + feedToken(user)
+	return "<br><div>read your subscriptions in a feed reader:</div>" +
+		"<div>" + base + "/feed.atom</div>" +
+		"<div>" + base + "/feed.json</div>"
+}
+
+// personalItem is one item of a personal feed with the feed it comes from.
+type personalItem struct {
+	url  string
+	feed *gofeed.Feed
+	item *gofeed.Item
+	date time.Time
+}
+
+// itemID identifies it in personal feeds by guid or link. Items without
+// either get a tag: URI (RFC 4151) from the feed url and a hash of the item,
+// so readers don't take them for new ones on every fetch.
+func itemID(it personalItem) string {
+	if it.item.GUID != "" {
+		return it.item.GUID
+	}
+	if it.item.Link != "" {
+		return it.item.Link
+	}
+
+	authority := "rss-email"
+	if u, err := url.Parse(it.url); err == nil && u.Hostname() != "" {
+		authority = u.Hostname()
+	}
+	hash := sha1.Sum([]byte(strings.Join([]string{it.url, it.item.Title, it.item.Published, it.item.Description, it.item.Content}, "\n")))
+	return "tag:" + authority + ",2020:" + hex.EncodeToString(hash[:])
+}
+
+func itemDate(item *gofeed.Item) time.Time {
+	if item.PublishedParsed != nil {
+		return *item.PublishedParsed
+	}
+	if item.UpdatedParsed != nil {
+		return *item.UpdatedParsed
+	}
+	return time.Time{}
+}
+
+// personalItems merges the cached feeds user subscribed to, newest first.
+// Caller must hold userSubscriptions and subscription locks.
+func personalItems(user string) []personalItem {
+	var items []personalItem
+	for url := range *userSubscriptions.m[user] {
+		urlInfo, ok := subscription.m[url]
+		if !ok || urlInfo.feed == nil {
+			continue
+		}
+		for _, item := range urlInfo.feed.Items {
+			items = append(items, personalItem{url, urlInfo.feed, item, itemDate(item)})
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].date.After(items[j].date) })
+	if len(items) > personalFeedItems {
+		items = items[:personalFeedItems]
+	}
+	return items
+}
+
+// userByToken returns the user owning a personal feed token, caller must hold
+// userSubscriptions lock.
+func userByToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for user, pref := range userSubscriptions.prefs {
+		if pref.Token == token {
+			if _, ok := userSubscriptions.m[user]; ok {
+				return user, true
+			}
+		}
+	}
+	return "", false
+}
+
+// handlePersonalFeed serves /u/<token>/feed.atom and /u/<token>/feed.json.
+func handlePersonalFeed(config *emailConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/u/"), "/")
+		if len(parts) != 2 || (parts[1] != "feed.atom" && parts[1] != "feed.json") {
+			http.NotFound(w, r)
+			return
+		}
+
+		userSubscriptions.RLock()
+		defer userSubscriptions.RUnlock()
+
+		user, ok := userByToken(parts[0])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		subscription.RLock()
+		items := personalItems(user)
+		subscription.RUnlock()
+
+		self := strings.TrimSuffix(config.publicURL, "/") + r.URL.Path
+		if parts[1] == "feed.atom" {
+			writeAtom(w, self, items)
+			return
+		}
+		writeJSONFeed(w, self, items)
+	}
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Link    atomLink     `xml:"link"`
+	Source  *atomSource  `xml:"source,omitempty"`
+	Content *atomContent `xml:"content,omitempty"`
+}
+
+type atomSource struct {
+	Title string   `xml:"title"`
+	Link  atomLink `xml:"link"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func writeAtom(w http.ResponseWriter, self string, items []personalItem) {
+	feed := &atomFeed{
+		ID:      self,
+		Title:   "rss-email subscriptions",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Link:    []atomLink{{Rel: "self", Href: self}},
+	}
+	if len(items) != 0 && !items[0].date.IsZero() {
+		feed.Updated = items[0].date.UTC().Format(time.RFC3339)
+	}
+
+	for _, it := range items {
+		entry := atomEntry{
+			ID:      itemID(it),
+			Title:   it.item.Title,
+			Updated: it.date.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: it.item.Link},
+			Source:  &atomSource{Title: it.feed.Title, Link: atomLink{Href: it.feed.Link}},
+		}
+		if content := itemContent(it.item.Content, it.item.Description); content != "" {
+			entry.Content = &atomContent{Type: "html", Body: content}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(feed)
+}
+
+// jsonFeed follows https://jsonfeed.org/version/1.1
+type jsonFeed struct {
+	Version string         `json:"version"`
+	Title   string         `json:"title"`
+	FeedURL string         `json:"feed_url"`
+	Items   []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string          `json:"id"`
+	URL           string          `json:"url,omitempty"`
+	Title         string          `json:"title,omitempty"`
+	ContentHTML   string          `json:"content_html,omitempty"`
+	DatePublished string          `json:"date_published,omitempty"`
+	Authors       []jsonFeedActor `json:"authors,omitempty"`
+}
+
+type jsonFeedActor struct {
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+func writeJSONFeed(w http.ResponseWriter, self string, items []personalItem) {
+	feed := &jsonFeed{
+		Version: "https://jsonfeed.org/version/1.1",
+		Title:   "rss-email subscriptions",
+		FeedURL: self,
+		Items:   []jsonFeedItem{},
+	}
+
+	for _, it := range items {
+		item := jsonFeedItem{
+			ID:          itemID(it),
+			URL:         it.item.Link,
+			Title:       it.item.Title,
+			ContentHTML: itemContent(it.item.Content, it.item.Description),
+			Authors:     []jsonFeedActor{{Name: it.feed.Title, URL: it.feed.Link}},
+		}
+		if !it.date.IsZero() {
+			item.DatePublished = it.date.Format(time.RFC3339)
+		}
+		feed.Items = append(feed.Items, item)
+	}
+
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	json.NewEncoder(w).Encode(feed)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func Test_handlePersonalFeed(t *testing.T) {
+	older := time.Date(2020, 4, 22, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2020, 4, 23, 0, 0, 0, 0, time.UTC)
+
+	userSubscriptions = newUserSubscriptions()
+	subscription = newSubscription()
+	defer func() {
+		userSubscriptions = newUserSubscriptions()
+		subscription = newSubscription()
+	}()
+
+	userSubscriptions.m["a@example.com"] = &userSubscriptionType{"https://a/feed": newUserURLInfo(), "https://b/feed": newUserURLInfo()}
+	userSubscriptions.setPref("a@example.com").Token = "token"
+	subscription.m["https://a/feed"] = &urlInfo{feed: &gofeed.Feed{Title: "A", Items: []*gofeed.Item{{Title: "a1", Link: "https://a/1", PublishedParsed: &older}}}}
+	subscription.m["https://b/feed"] = &urlInfo{feed: &gofeed.Feed{Title: "B", Items: []*gofeed.Item{{Title: "b1", Link: "https://b/1", PublishedParsed: &newer}}}}
+
+	handler := handlePersonalFeed(&emailConfig{publicURL: "https://rss.example.com"})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/u/token/feed.json", nil))
+	var feed jsonFeed
+	if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("error %q decoding %q", err, w.Body.String())
+	}
+	if len(feed.Items) != 2 || feed.Items[0].Title != "b1" || feed.Items[1].Title != "a1" {
+		t.Errorf("feed.json items == %+v, want b1 then a1", feed.Items)
+	}
+	if feed.FeedURL != "https://rss.example.com/u/token/feed.json" {
+		t.Errorf("feed_url == %q", feed.FeedURL)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/u/other/feed.atom", nil))
+	if w.Code != 404 {
+		t.Errorf("unknown token answered %d, want 404", w.Code)
+	}
+}
+
+func Test_itemID(t *testing.T) {
+	untitled := personalItem{url: "https://a.example.com/feed", item: &gofeed.Item{Title: "a1", Published: "Thu, 23 Apr 2020 10:00:00 GMT"}}
+	id := itemID(untitled)
+	tests := []struct {
+		name string
+		it   personalItem
+		want string
+	}{
+		{"guid", personalItem{url: "https://a.example.com/feed", item: &gofeed.Item{GUID: "urn:a1", Link: "https://a.example.com/1"}}, "urn:a1"},
+		{"link", personalItem{url: "https://a.example.com/feed", item: &gofeed.Item{Link: "https://a.example.com/1"}}, "https://a.example.com/1"},
+		// stable across fetches, which make new items
+		{"neither", personalItem{url: "https://a.example.com/feed", item: &gofeed.Item{Title: "a1", Published: "Thu, 23 Apr 2020 10:00:00 GMT"}}, id},
+	}
+	for _, tt := range tests {
+		if got := itemID(tt.it); got != tt.want {
+			t.Errorf("%s: itemID() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if !strings.HasPrefix(id, "tag:a.example.com,2020:") {
+		t.Errorf("itemID() = %q, want a tag: URI of a.example.com", id)
+	}
+	// other items and the same item in another feed differ
+	others := []personalItem{
+		{url: untitled.url, item: &gofeed.Item{Title: "a2", Published: untitled.item.Published}},
+		{url: "https://b.example.com/feed", item: untitled.item},
+		{url: untitled.url, item: &gofeed.Item{}},
+	}
+	for _, other := range others {
+		if itemID(other) == id {
+			t.Errorf("itemID(%+v) = %q, same as %+v", *other.item, id, *untitled.item)
+		}
+	}
+}
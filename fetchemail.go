@@ -7,10 +7,13 @@ import (
 	"log"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/mail"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
@@ -22,205 +25,805 @@ const responseListSubject = "[rss-email] list command response"
 const responseUnsubscribeSubject = "[rss-email] successfully unsubscribe"
 const responseNotSubscribeSubject = "[rss-email] you haven't subscribed yet."
 const responseNotSubscribeBody = "you haven't subscribed yet."
+const responseChangeSubject = "[rss-email] subscriptions changed"
+const responseChangeSubjectFail = "[rss-email] subscriptions unchanged"
+const responseTagSubject = "[rss-email] successfully tag"
+const responseTagSubjectFail = "[rss-email] unsuccessfully tag"
+const responseWebhookSubject = "[rss-email] webhook command response"
+const responseTemplateSubject = "[rss-email] template command response"
+const responseFormatSubject = "[rss-email] format command response"
+const responseLimitSubject = "[rss-email] limit command response"
+const responseImagesSubject = "[rss-email] images command response"
+const responseAttachSubject = "[rss-email] attach command response"
+const responseSortSubject = "[rss-email] sort command response"
 const responseSubjectHelp = "[rss-email] unrecognized command"
 const responseBodyHelp = `
 <h3>Usage:</h3>
 <p>Email subject: rss-email [COMMAND]</p>
-<p>COMMAND is one of : subscribe, list, unsubscribe</p>
+<p>COMMAND is one of : subscribe, add, remove, list, unsubscribe, tag [TAG], webhook URL|off|test, template full|compact|headlines, format html|text, limit items|total|truncate|size N, images remote|strip|embed, attach on|off, sort tag|title|newest</p>
+<p>subscribe: replaces your subscriptions with the RSS urls listed in the message body</p>
+<p>add, remove: adds or removes the RSS urls listed in the message body, keeping the others</p>
+<p>tag: tags the subscribed RSS urls listed in the message body, without TAG the tag is removed</p>
+<p>template: full digests carry whole items, compact ones their summary, headlines only titles</p>
+<p>format: text sends digests as plain text, html (the default) as HTML</p>
+<p>limit: caps full items per feed (only of the subscribed RSS urls listed in the message body if any) or per digest, characters per item, or kilobytes per digest, the other items are listed as headlines, 0 for the default</p>
+<p>images: remote leaves images on their servers, strip removes them, embed attaches them to the digest</p>
+<p>attach: attaches small enclosures, like PDFs or images, of the subscribed RSS urls listed in the message body to the digest</p>
+<p>sort: orders feeds in digests by tag, grouping them, by title, or by their newest item</p>
+<p>webhook: POSTs new items to URL, only those of the subscribed RSS urls listed in the message body if any</p>
 <br>
 <p>For more details: https://github.com/derekchuank/rss-email</p>
 `
 
 const httpRegex = `(?:http(s)?:\/\/)?[\w.-]+(?:\.[\w\.-]+)+[\w\-\._~:/?#[\]@!\$&'\(\)\*\+,;=.]+\r\n`
 
-func fetchemail(config *emailConfig) error {
-	c, err := client.DialTLS(config.imapServer, nil)
+// the first delay before reconnecting to the imap server, doubled on every failure
+const imapMinBackoff = 10 * time.Second
+
+// upper bound of the delay before reconnecting
+const imapMaxBackoff = 10 * time.Minute
+
+// watchInbox keeps an imap connection open and handles commands as soon as they
+// arrive, until stop is closed.
+func watchInbox(config *emailConfig, stop <-chan struct{}) {
+	backoff := imapMinBackoff
+	for {
+		loggedIn, err := watchInboxOnce(config, stop)
+		if err == nil {
+			return
+		}
+		if loggedIn {
+			backoff = imapMinBackoff
+		}
+
+		log.Printf("imap connection lost, reconnecting in %v: %v", backoff, err)
+		jobs.setError(config.inbox, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > imapMaxBackoff {
+			backoff = imapMaxBackoff
+		}
+	}
+}
+
+// watchInboxOnce serves one imap connection. It returns a nil error only when
+// stop is closed.
+func watchInboxOnce(config *emailConfig, stop <-chan struct{}) (bool, error) {
+	c, err := dialIMAP(config)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	defer c.Logout()
+	// the client blocks until updates are read, so keep reading them and
+	// only remember that something changed
+	updates := make(chan client.Update, 10)
+	changed := make(chan struct{}, 1)
+	c.Updates = updates
+	go func() {
+		for range updates {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	defer func() {
+		if err := c.Logout(); err != nil {
+			c.Terminate()
+		}
+		<-c.LoggedOut()
+		close(updates)
+	}()
 
 	if err := c.Login(config.username, config.password); err != nil {
-		return err
+		return false, err
 	}
 
-	if err := fetchFromBox(config, c, "INBOX"); err != nil {
-		log.Printf("error fetchFromBox INBOX")
+	mailboxes, err := mailboxesToScan(config, c)
+	if err != nil {
+		return true, err
 	}
+	log.Printf("scanning mailboxes %q", mailboxes)
+
+	for {
+		log.Println("fetchemail ...")
+		jobs.start("fetchemail")
+		err := fetchemail(config, c, mailboxes)
+		jobs.finish("fetchemail", err)
+		if err != nil {
+			return true, err
+		}
+
+		if _, err := c.Select(mailboxes[0], false); err != nil {
+			return true, err
+		}
+		// forget updates caused by our own commands
+		select {
+		case <-changed:
+		default:
+		}
 
-	// Junk can contain messages useful
-	if err := fetchFromBox(config, c, "Junk"); err != nil {
-		log.Printf("error fetchFromBox Junk")
+		// wait for new messages in the first mailbox, others are checked every
+		// config.fetchemailInterval. Without IDLE support the server is polled.
+		idleStop := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- c.Idle(idleStop, &client.IdleOptions{PollInterval: time.Minute})
+		}()
+
+		timer := time.NewTimer(config.fetchemailInterval)
+		select {
+		case <-stop:
+			timer.Stop()
+			close(idleStop)
+			<-idleDone
+			return true, nil
+		case err := <-idleDone:
+			timer.Stop()
+			return true, err
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		close(idleStop)
+		if err := <-idleDone; err != nil {
+			return true, err
+		}
+	}
+}
+
+// fetchemail handles the unseen commands of every mailbox and saves the result.
+func fetchemail(config *emailConfig, c *client.Client, mailboxes []string) error {
+	userSubscriptions.Lock()
+	defer userSubscriptions.Unlock()
+
+	for _, mailbox := range mailboxes {
+		if err := fetchFromBox(config, c, mailbox); err != nil {
+			log.Printf("error fetchFromBox %s: %v", mailbox, err)
+		}
 	}
 
+	if config.dryRun {
+		return nil
+	}
+	if err := userSubscriptions.saveToDisk(); err != nil {
+		log.Panicln("error save to disk")
+	}
+	log.Println("user info saved to disk")
+
 	return nil
 }
 
+// mailboxesToScan returns the configured mailboxes, followed by the junk
+// mailbox advertised with the SPECIAL-USE \Junk attribute, since junk can
+// contain messages useful.
+func mailboxesToScan(config *emailConfig, c *client.Client) ([]string, error) {
+	mailboxes := append([]string(nil), config.mailboxes...)
+	if !config.scanJunk {
+		return mailboxes, nil
+	}
+
+	ch := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", ch)
+	}()
+
+	var junk, junkByName string
+	for info := range ch {
+		for _, attr := range info.Attributes {
+			if attr == imap.JunkAttr && junk == "" {
+				junk = info.Name
+			}
+		}
+		// servers without SPECIAL-USE, like the ones rss-email used to know
+		if info.Name == "Junk" {
+			junkByName = info.Name
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	if junk == "" {
+		junk = junkByName
+	}
+	if junk == "" {
+		log.Println("no junk mailbox found")
+		return mailboxes, nil
+	}
+
+	for _, mailbox := range mailboxes {
+		if mailbox == junk {
+			return mailboxes, nil
+		}
+	}
+	return append(mailboxes, junk), nil
+}
+
+// dialIMAP connects to the imap server using the configured transport security.
+func dialIMAP(config *emailConfig) (*client.Client, error) {
+	host, _, err := net.SplitHostPort(config.imapServer)
+	if err != nil {
+		host = config.imapServer
+	}
+
+	tlsConf, err := config.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.imapTLS == tlsImplicit {
+		return client.DialTLS(config.imapServer, tlsConf)
+	}
+
+	c, err := client.Dial(config.imapServer)
+	if err != nil {
+		return nil, err
+	}
+	if config.imapTLS == tlsPlain {
+		return c, nil
+	}
+
+	ok, err := c.SupportStartTLS()
+	if err != nil {
+		c.Logout()
+		return nil, err
+	}
+	if !ok {
+		c.Logout()
+		if config.imapTLS == tlsStartTLS {
+			return nil, errors.New("imap server doesn't support STARTTLS")
+		}
+		return nil, errCleartextLogin
+	}
+	if err := c.StartTLS(tlsConf); err != nil {
+		c.Logout()
+		return nil, err
+	}
+
+	return c, nil
+}
+
 func fetchFromBox(config *emailConfig, c *client.Client, boxType string) error {
 	mbox, err := c.Select(boxType, false)
 	if err != nil {
 		return err
 	}
 
-	if mbox.UnseenSeqNum == 0 {
-		log.Println("no unseen emails")
-		return nil
+	checkpoint := checkpoints.get(boxType, mbox.UidValidity)
+	if config.dryRun {
+		// the read position stays, a real run after a reload handles them
+		dryRun := *checkpoint
+		checkpoint = &dryRun
 	}
 
-	from := mbox.UnseenSeqNum
-	to := mbox.Messages
+	// unseen messages we haven't handled yet
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uidRange := new(imap.SeqSet)
+	uidRange.AddRange(checkpoint.LastUID+1, 0)
+	criteria.Uid = uidRange
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
 
 	seqset := new(imap.SeqSet)
-	seqset.AddRange(from, to)
+	for _, uid := range uids {
+		// n:* always matches the highest uid, even when it's below n
+		if uid > checkpoint.LastUID {
+			seqset.AddNum(uid)
+		}
+	}
+	if seqset.Empty() {
+		log.Println("no unseen emails")
+		return nil
+	}
 
 	messages := make(chan *imap.Message, 10)
 	done := make(chan error, 1)
 
-	// Get the whole message body
-	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{section.FetchItem()}
+	// Get the whole message body, PEEK leaves \Seen to us
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{section.FetchItem(), imap.FetchUid}
 	go func() {
-		done <- c.Fetch(seqset, items, messages)
+		done <- c.UidFetch(seqset, items, messages)
 	}()
 
+	// no other command can run before the fetch completes
+	var fetched []*imap.Message
 	for msg := range messages {
-		r := msg.GetBody(section)
-		if r == nil {
-			return errors.New("Server didn't returned message body")
+		fetched = append(fetched, msg)
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	sort.Slice(fetched, func(i, j int) bool { return fetched[i].Uid < fetched[j].Uid })
+
+	processed := new(imap.SeqSet)
+	var processedNum int
+	var failed bool
+	for _, msg := range fetched {
+		isCommand, err := processFetched(config, msg, section)
+		if err != nil {
+			// keep it unseen and retry next time
+			log.Printf("error processing message %d in %s: %v", msg.Uid, boxType, err)
+			failed = true
+			continue
 		}
 
-		msg, err := mail.ReadMessage(r)
+		if !failed {
+			checkpoint.LastUID = msg.Uid
+		}
+		if isCommand {
+			processed.AddNum(msg.Uid)
+			processedNum++
+		}
+	}
+
+	// a real run handles them again
+	if config.dryRun {
+		if processedNum > 0 {
+			log.Printf("dry run: %d commands in %s left unseen", processedNum, boxType)
+		}
+		return nil
+	}
+
+	if err := checkpoints.saveToDisk(); err != nil {
+		return err
+	}
+
+	if processed.Empty() {
+		return nil
+	}
+
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(processed, item, []interface{}{imap.SeenFlag}, nil); err != nil {
+		return err
+	}
+
+	if config.processedMailbox != "" && config.processedMailbox != boxType {
+		// fails harmlessly when the mailbox already exists
+		c.Create(config.processedMailbox)
+		if err := c.UidMove(processed, config.processedMailbox); err != nil {
+			return err
+		}
+		log.Printf("%d processed emails moved to %s", processedNum, config.processedMailbox)
+	}
+
+	return nil
+}
+
+// processFetched handles one fetched message, it reports whether the message
+// is an rss-email command. Errors mean the message should be retried.
+func processFetched(config *emailConfig, fetched *imap.Message, section *imap.BodySectionName) (bool, error) {
+	r := fetched.GetBody(section)
+	if r == nil {
+		return false, errors.New("Server didn't returned message body")
+	}
+
+	return processRaw(config, r)
+}
+
+// processRaw parses one raw message and handles it when it's an rss-email
+// command, whichever protocol it was fetched with. It reports whether the
+// message is a command, errors mean it should be retried.
+func processRaw(config *emailConfig, r io.Reader) (bool, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		// malformed, retrying won't help
+		log.Println(err)
+		return false, nil
+	}
+
+	if !isCommand(msg) {
+		return false, nil
+	}
+
+	return true, processMessage(config, msg)
+}
+
+func isCommand(msg *mail.Message) bool {
+	subjectArgs := strings.SplitN(msg.Header.Get("Subject"), " ", 2)
+	return subjectArgs[0] == "rss-email"
+}
+
+// processMessage runs the command in msg and queues the response.
+func processMessage(config *emailConfig, msg *mail.Message) error {
+	header := msg.Header
+	fromAddress, err := mail.ParseAddress(header.Get("From"))
+	if err != nil {
+		log.Println("errors parsing fromAddress")
+		return nil
+	}
+	fromAddressAddress := fromAddress.Address
+	subject := header.Get("Subject")
+
+	subjectArgs := strings.SplitN(subject, " ", 2)
+	if subjectArgs[0] != "rss-email" {
+		log.Println("get one non-rss-email email")
+		return nil
+	}
+
+	log.Println("get one rss-email email")
+
+	var command string
+	if len(subjectArgs) == 2 {
+		command = subjectArgs[1]
+	}
+	commandsProcessed.WithLabelValues(commandLabel(command)).Inc()
+
+	// the sender is reachable again, see suspendFailed
+	if pref, ok := userSubscriptions.prefs[fromAddressAddress]; ok && pref.Suspended != "" {
+		log.Printf("sending to %s resumed", fromAddressAddress)
+		pref.Suspended = ""
+	}
+
+	// process emails recieved
+	if command == "subscribe" {
+		slurp, err := parseMultipart(msg)
 		if err != nil {
+			if err := queueEmail(config, fromAddressAddress, responseSubscribeSubjectFail, err.Error()); err != nil {
+				log.Printf("error queueEmail in subscribe response")
+				return err
+			}
+			return nil
+		}
+
+		validUrls := extractURLs(slurp)
+		if len(validUrls) == 0 {
+			failBody := "This is the mail body we received: " + string(slurp)
+			if err := queueEmail(config, fromAddressAddress, responseSubscribeSubjectFail, failBody); err != nil {
+				log.Printf("error queueEmail in subscribe response")
+				return err
+			}
+			return nil
+		}
+
+		responseBody, err := subscribeUser(fromAddressAddress, validUrls).printToUser()
+		if err != nil {
+			log.Println("error printToUser")
+			return nil
+		}
+		responseBody += personalFeedLinks(config, fromAddressAddress)
+
+		if err := queueEmail(config, fromAddressAddress, responseSubscribeSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in subscribe response")
 			return err
 		}
+		return nil
+	}
+	if command == "list" {
+		_, ok := userSubscriptions.m[fromAddressAddress]
+		if !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed list response")
+				return err
+			}
+			return nil
+		}
 
-		header := msg.Header
-		fromAddress, err := mail.ParseAddress(header.Get("From"))
+		responseBody, err := userSubscriptions.m[fromAddressAddress].printToUser()
 		if err != nil {
-			log.Println("errors parsing fromAddress")
+			log.Println("error printToUser")
+			return nil
 		}
-		fromAddressAddress := fromAddress.Address
-		subject := header.Get("Subject")
+		responseBody += personalFeedLinks(config, fromAddressAddress)
 
-		subjectArgs := strings.SplitN(subject, " ", 2)
-		if subjectArgs[0] != "rss-email" {
-			log.Println("get one non-rss-email email")
-			continue
+		if err := queueEmail(config, fromAddressAddress, responseListSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in list response")
+			return err
+		}
+		return nil
+	}
+	if command == "unsubscribe" {
+		_, ok := userSubscriptions.m[fromAddressAddress]
+		if !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed unsubscribe response")
+				return err
+			}
 		}
 
-		log.Println("get one rss-email email")
+		if err := queueEmail(config, fromAddressAddress, responseUnsubscribeSubject, ""); err != nil {
+			log.Printf("error queueEmail in unsubscribe response")
+			return err
+		}
 
-		var command string
-		if len(subjectArgs) == 2 {
-			command = subjectArgs[1]
+		unsubscribeUser(fromAddressAddress)
+		return nil
+	}
+
+	if command == "add" || command == "remove" {
+		slurp, err := parseMultipart(msg)
+		if err != nil {
+			if err := queueEmail(config, fromAddressAddress, responseChangeSubjectFail, err.Error()); err != nil {
+				log.Printf("error queueEmail in %s response", command)
+				return err
+			}
+			return nil
 		}
 
-		// process emails recieved
-		if command == "subscribe" {
-			slurp, err := parseMultipart(msg)
-			if err != nil {
-				if err := sendemail(config, fromAddressAddress, responseSubscribeSubjectFail, err.Error()); err != nil {
-					log.Printf("error sendemail in subscribe response")
-					continue
+		validUrls := extractURLs(slurp)
+		if len(validUrls) == 0 {
+			failBody := "This is the mail body we received: " + string(slurp)
+			if err := queueEmail(config, fromAddressAddress, responseChangeSubjectFail, failBody); err != nil {
+				log.Printf("error queueEmail in %s response", command)
+				return err
+			}
+			return nil
+		}
+
+		var userSubscription *userSubscriptionType
+		if command == "add" {
+			userSubscription = addSubscriptions(fromAddressAddress, validUrls)
+		} else {
+			var ok bool
+			userSubscription, ok = removeSubscriptions(fromAddressAddress, validUrls)
+			if !ok {
+				if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+					log.Printf("error queueEmail in failed remove response")
+					return err
 				}
-				continue
+				return nil
 			}
+		}
 
-			re := regexp.MustCompile(httpRegex)
-			urlStrs := re.FindAll(slurp, -1)
-			var validUrls []string
-			for _, urlStr := range urlStrs {
-				urlStr = urlStr[:len(urlStr)-2]
+		responseBody, err := userSubscription.printToUser()
+		if err != nil {
+			log.Println("error printToUser")
+			return nil
+		}
+		responseBody += personalFeedLinks(config, fromAddressAddress)
 
-				u, err := url.Parse(string(urlStr))
-				if err != nil {
-					log.Println(err)
-					continue
-				}
+		if err := queueEmail(config, fromAddressAddress, responseChangeSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in %s response", command)
+			return err
+		}
+		return nil
+	}
 
-				validUrls = append(validUrls, u.String())
+	if command == "tag" || strings.HasPrefix(command, "tag ") {
+		userSubscription, ok := userSubscriptions.m[fromAddressAddress]
+		if !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed tag response")
+				return err
 			}
+			return nil
+		}
 
-			if len(validUrls) == 0 {
-				failBody := "This is the mail body we received: " + string(slurp)
-				if err := sendemail(config, fromAddressAddress, responseSubscribeSubjectFail, failBody); err != nil {
-					log.Printf("error sendemail in subscribe response")
-					continue
-				}
-				continue
+		// tags name imap folders, keep them on one level
+		tag := strings.TrimSpace(strings.TrimPrefix(command, "tag"))
+		tag = strings.ReplaceAll(tag, "/", "-")
+
+		slurp, err := parseMultipart(msg)
+		if err != nil {
+			if err := queueEmail(config, fromAddressAddress, responseTagSubjectFail, err.Error()); err != nil {
+				log.Printf("error queueEmail in tag response")
+				return err
 			}
+			return nil
+		}
 
-			userSubscriptions.m[fromAddressAddress] = newUserSubscription()
+		for _, url := range normalizeURLs(extractURLs(slurp)) {
+			if info, ok := (*userSubscription)[url]; ok {
+				info.Tag = tag
+			}
+		}
 
-			for _, url := range validUrls {
-				(*userSubscriptions.m[fromAddressAddress])[url] = newUserURLInfo()
+		responseBody, err := userSubscription.printToUser()
+		if err != nil {
+			log.Println("error printToUser")
+			return nil
+		}
+
+		if err := queueEmail(config, fromAddressAddress, responseTagSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in tag response")
+			return err
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(command, "webhook ") {
+		userSubscription, ok := userSubscriptions.m[fromAddressAddress]
+		if !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed webhook response")
+				return err
 			}
+			return nil
+		}
 
-			responseBody, err := userSubscriptions.m[fromAddressAddress].printToUser()
-			if err != nil {
-				log.Println("error printToUser")
-				continue
+		responseBody := runWebhookCommand(config, fromAddressAddress, userSubscription, msg, strings.TrimSpace(strings.TrimPrefix(command, "webhook")))
+		if err := queueEmail(config, fromAddressAddress, responseWebhookSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in webhook response")
+			return err
+		}
+		return nil
+	}
+
+	if command == "template" || strings.HasPrefix(command, "template ") {
+		if _, ok := userSubscriptions.m[fromAddressAddress]; !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed template response")
+				return err
 			}
+			return nil
+		}
 
-			if err := sendemail(config, fromAddressAddress, responseSubscribeSubject, responseBody); err != nil {
-				log.Printf("error sendemail in subscribe response")
-				continue
+		name := strings.TrimSpace(strings.TrimPrefix(command, "template"))
+		responseBody := "<div>unknown template, choose one of: " + strings.Join(knownTemplates, ", ") + "</div>"
+		if validTemplate(name) {
+			userSubscriptions.setPref(fromAddressAddress).Template = name
+			responseBody = "<div>your digests use the " + name + " template</div>"
+		}
+		if err := queueEmail(config, fromAddressAddress, responseTemplateSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in template response")
+			return err
+		}
+		return nil
+	}
+
+	if command == "format" || strings.HasPrefix(command, "format ") {
+		if _, ok := userSubscriptions.m[fromAddressAddress]; !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed format response")
+				return err
 			}
-			continue
+			return nil
 		}
-		if command == "list" {
-			_, ok := userSubscriptions.m[fromAddressAddress]
-			if !ok {
-				if err := sendemail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
-					log.Printf("error sendemail in failed list response")
-					continue
-				}
-				continue
+
+		format := strings.TrimSpace(strings.TrimPrefix(command, "format"))
+		responseBody := "<div>unknown format, choose one of: html, text</div>"
+		if format == formatHTML || format == formatText {
+			userSubscriptions.setPref(fromAddressAddress).Format = format
+			responseBody = "<div>your digests are sent as " + format + "</div>"
+		}
+		if err := queueEmail(config, fromAddressAddress, responseFormatSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in format response")
+			return err
+		}
+		return nil
+	}
+
+	if command == "sort" || strings.HasPrefix(command, "sort ") {
+		if _, ok := userSubscriptions.m[fromAddressAddress]; !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed sort response")
+				return err
 			}
+			return nil
+		}
 
-			responseBody, err := userSubscriptions.m[fromAddressAddress].printToUser()
-			if err != nil {
-				log.Println("error printToUser")
-				continue
+		order := strings.TrimSpace(strings.TrimPrefix(command, "sort"))
+		responseBody := "<div>unknown order, choose one of: tag, title, newest</div>"
+		if validSort(order) {
+			userSubscriptions.setPref(fromAddressAddress).Sort = order
+			responseBody = "<div>feeds in your digests are sorted by " + order + "</div>"
+		}
+		if err := queueEmail(config, fromAddressAddress, responseSortSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in sort response")
+			return err
+		}
+		return nil
+	}
+
+	if command == "attach on" || command == "attach off" {
+		userSubscription, ok := userSubscriptions.m[fromAddressAddress]
+		if !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed attach response")
+				return err
 			}
+			return nil
+		}
 
-			if err := sendemail(config, fromAddressAddress, responseListSubject, responseBody); err != nil {
-				log.Printf("error sendemail in list response")
-				continue
+		slurp, err := parseMultipart(msg)
+		if err != nil {
+			if err := queueEmail(config, fromAddressAddress, responseAttachSubject, err.Error()); err != nil {
+				log.Printf("error queueEmail in attach response")
+				return err
 			}
-			continue
+			return nil
 		}
-		if command == "unsubscribe" {
-			_, ok := userSubscriptions.m[fromAddressAddress]
-			if !ok {
-				if err := sendemail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
-					log.Printf("error sendemail in failed unsubscribe response")
-					continue
-				}
+
+		for _, url := range normalizeURLs(extractURLs(slurp)) {
+			if info, ok := (*userSubscription)[url]; ok {
+				info.Attach = command == "attach on"
 			}
+		}
 
-			delete(userSubscriptions.m, fromAddressAddress)
+		responseBody, err := userSubscription.printToUser()
+		if err != nil {
+			log.Println("error printToUser")
+			return nil
+		}
 
-			if err := sendemail(config, fromAddressAddress, responseUnsubscribeSubject, ""); err != nil {
-				log.Printf("error sendemail in unsubscribe response")
-				continue
+		if err := queueEmail(config, fromAddressAddress, responseAttachSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in attach response")
+			return err
+		}
+		return nil
+	}
+
+	if command == "images" || strings.HasPrefix(command, "images ") {
+		if _, ok := userSubscriptions.m[fromAddressAddress]; !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed images response")
+				return err
 			}
-			continue
+			return nil
 		}
 
-		if err := sendemail(config, fromAddressAddress, responseSubjectHelp, responseBodyHelp); err != nil {
-			log.Printf("error sendemail in response help")
-			continue
+		policy := strings.TrimSpace(strings.TrimPrefix(command, "images"))
+		responseBody := "<div>unknown image policy, choose one of: remote, strip, embed</div>"
+		if validImages(policy) {
+			userSubscriptions.setPref(fromAddressAddress).Images = policy
+			responseBody = "<div>images in your digests are: " + policy + "</div>"
+		}
+		if err := queueEmail(config, fromAddressAddress, responseImagesSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in images response")
+			return err
 		}
+		return nil
 	}
 
-	if err := <-done; err != nil {
+	if command == "limit" || strings.HasPrefix(command, "limit ") {
+		userSubscription, ok := userSubscriptions.m[fromAddressAddress]
+		if !ok {
+			if err := queueEmail(config, fromAddressAddress, responseNotSubscribeSubject, responseNotSubscribeBody); err != nil {
+				log.Printf("error queueEmail in failed limit response")
+				return err
+			}
+			return nil
+		}
+
+		responseBody := runLimitCommand(config, fromAddressAddress, userSubscription, msg, strings.TrimPrefix(command, "limit"))
+		if err := queueEmail(config, fromAddressAddress, responseLimitSubject, responseBody); err != nil {
+			log.Printf("error queueEmail in limit response")
+			return err
+		}
+		return nil
+	}
+
+	if err := queueEmail(config, fromAddressAddress, responseSubjectHelp, responseBodyHelp); err != nil {
+		log.Printf("error queueEmail in response help")
 		return err
 	}
+
 	return nil
 }
 
+// extractURLs returns the urls found in a message body, one per line.
+func extractURLs(slurp []byte) []string {
+	re := regexp.MustCompile(httpRegex)
+	urlStrs := re.FindAll(slurp, -1)
+	var validUrls []string
+	for _, urlStr := range urlStrs {
+		urlStr = urlStr[:len(urlStr)-2]
+
+		u, err := url.Parse(string(urlStr))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		validUrls = append(validUrls, u.String())
+	}
+
+	return validUrls
+}
+
 func parseMultipart(msg *mail.Message) ([]byte, error) {
 	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
 	if err != nil {
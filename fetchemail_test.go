@@ -49,3 +49,67 @@ func Test_parseMultipart(t *testing.T) {
 		}
 	}
 }
+
+func Test_extractURLs(t *testing.T) {
+	in := "https://golang.org/feed.atom\r\nnot an url\r\nblog.golang.org/feed.atom\r\n"
+	want := []string{"https://golang.org/feed.atom", "blog.golang.org/feed.atom"}
+
+	got := extractURLs([]byte(in))
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("extractURLs(%q) == %q, want %q", in, got, want)
+	}
+}
+
+func Test_mailboxesToScan(t *testing.T) {
+	tests := []struct {
+		name      string
+		mailboxes []string
+		scanJunk  bool
+		list      []string
+		want      []string
+	}{
+		{"special-use junk", []string{"INBOX"}, true, []string{`() "/" "INBOX"`, `(\HasNoChildren \Junk) "/" "Spam"`}, []string{"INBOX", "Spam"}},
+		{"special-use before name", []string{"INBOX"}, true, []string{`() "/" "Junk"`, `(\Junk) "/" "Spam"`}, []string{"INBOX", "Spam"}},
+		{"junk by name", []string{"INBOX"}, true, []string{`() "/" "INBOX"`, `() "/" "Junk"`}, []string{"INBOX", "Junk"}},
+		{"no junk", []string{"INBOX"}, true, []string{`() "/" "INBOX"`, `(\Sent) "/" "Sent"`}, []string{"INBOX"}},
+		{"junk disabled", []string{"INBOX"}, false, []string{`(\Junk) "/" "Spam"`}, []string{"INBOX"}},
+		{"junk listed in mailboxes", []string{"Spam", "INBOX"}, true, []string{`() "/" "INBOX"`, `(\Junk) "/" "Spam"`}, []string{"Spam", "INBOX"}},
+	}
+	for _, tt := range tests {
+		list := tt.list
+		addr, received := lineServer(t, "* OK [CAPABILITY IMAP4rev1] fake\r\n", func(line string) string {
+			fields := strings.Fields(line)
+			var untagged string
+			if strings.ToUpper(fields[1]) == "LIST" {
+				for _, info := range list {
+					untagged += "* LIST " + info + "\r\n"
+				}
+			}
+			return untagged + fields[0] + " OK done\r\n"
+		})
+		config := &emailConfig{imapServer: addr, imapTLS: tlsPlain, mailboxes: tt.mailboxes, scanJunk: tt.scanJunk}
+		c, err := dialIMAP(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Login("rss", "secret"); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := mailboxesToScan(config, c)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: mailboxesToScan() = %q, want %q", tt.name, got, tt.want)
+		}
+		if !tt.scanJunk {
+			for _, line := range received() {
+				if strings.Contains(line, "LIST") {
+					t.Errorf("%s: listed mailboxes with -scanJunk=false", tt.name)
+				}
+			}
+		}
+		c.Logout()
+	}
+}
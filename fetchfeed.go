@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/mmcdole/gofeed"
@@ -15,27 +17,75 @@ type httpGetRes struct {
 	error error
 }
 
-func fetchfeed(config *emailConfig) error {
-	ch := make(chan *httpGetRes)
+// errFetchRunning is returned by runFetchfeed while another cycle runs.
+var errFetchRunning = errors.New("a feed fetch is already running")
+
+// fetching is 1 while a fetchfeed cycle runs, the ticker's or the API's
+var fetching int32
+
+// runFetchfeed runs the fetchfeed job, unless it's running already.
+func runFetchfeed(config *emailConfig) error {
+	if !atomic.CompareAndSwapInt32(&fetching, 0, 1) {
+		return errFetchRunning
+	}
+	defer atomic.StoreInt32(&fetching, 0)
+
+	jobs.start("fetchfeed")
+	addSubscribedURLs()
+	log.Println("fetchfeed ...")
+	err := fetchfeed(config)
+	jobs.finish("fetchfeed", err)
+	return err
+}
+
+// addSubscribedURLs makes sure every url some user subscribed to is fetched.
+func addSubscribedURLs() {
+	userSubscriptions.RLock()
+	defer userSubscriptions.RUnlock()
+
+	subscription.Lock()
+	defer subscription.Unlock()
+
+	for _, v := range userSubscriptions.m {
+		for url := range *v {
+			if _, ok := subscription.m[url]; !ok {
+				subscription.m[url] = newURLInfo()
+			}
+		}
+	}
+}
 
-	var goNum int
+func fetchfeed(config *emailConfig) error {
+	var urls []string
 	subscription.RLock()
 	for url := range subscription.m {
 		// url not a valid feed
 		if subscription.m[url].error != nil && subscription.m[url].error.Error() == "Failed to detect feed type" {
 			continue
 		}
-		go func() {
+		urls = append(urls, url)
+	}
+	subscription.RUnlock()
+
+	return fetchURLs(urls)
+}
+
+// fetchURLs downloads and parses urls concurrently, the result is saved to
+// subscription. Every url must be in subscription.m.
+func fetchURLs(urls []string) error {
+	ch := make(chan *httpGetRes)
+
+	for _, url := range urls {
+		go func(url string) {
 			res, err := httpGet(url)
 			ch <- &httpGetRes{
 				url:   url,
 				txt:   res,
 				error: err,
 			}
-		}()
-		goNum++
+		}(url)
 	}
-	subscription.RUnlock()
+	goNum := len(urls)
 
 	for i := 0; i < goNum; i++ {
 		// block here
@@ -56,6 +106,7 @@ func fetchfeed(config *emailConfig) error {
 		feedParser := gofeed.NewParser()
 		feed, err := feedParser.ParseString(txt)
 		if err != nil {
+			feedParseErrors.Inc()
 			subscription.m[url].error = err
 
 			subscription.Unlock()
@@ -66,6 +117,7 @@ func fetchfeed(config *emailConfig) error {
 		subscription.m[url].raw = txt
 		subscription.m[url].lastUpdate = time.Now()
 		subscription.m[url].feed = feed
+		subscription.m[url].error = nil
 
 		subscription.Unlock()
 	}
@@ -80,15 +132,20 @@ func httpGet(url string) (string, error) {
 		return "", err
 	}
 
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
+		feedFetches.WithLabelValues("error").Inc()
 		return "", err
 	}
 	defer resp.Body.Close()
 
 	output, err := ioutil.ReadAll(resp.Body)
+	feedFetchDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		feedFetches.WithLabelValues("error").Inc()
 		return "", err
 	}
+	feedFetches.WithLabelValues(statusClass(resp.StatusCode)).Inc()
 	return string(output), nil
 }
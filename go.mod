@@ -1,11 +1,13 @@
 module github.com/derekchuank/rss-email
 
-go 1.14
+go 1.16
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.1 // indirect
-	github.com/emersion/go-imap v1.0.4
+	github.com/emersion/go-imap v1.2.1
 	github.com/mmcdole/gofeed v1.0.0-beta2
 	github.com/mmcdole/goxpp v0.0.0-20181012175147-0068e33feabf // indirect
-	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e // indirect
+	github.com/prometheus/client_golang v1.7.1
+	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
+	gopkg.in/yaml.v2 v2.4.0
 )
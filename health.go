@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jobStatus is the recent history of one periodic job.
+type jobStatus struct {
+	Interval      time.Duration `json:"-"`
+	LastRun       time.Time     `json:"last_run"`
+	LastCompleted time.Time     `json:"last_completed"`
+	LastSuccess   time.Time     `json:"last_success"`
+	LastError     string        `json:"last_error,omitempty"`
+}
+
+// errorStatus is the last error of a connection.
+type errorStatus struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+type jobsType struct {
+	sync.Mutex
+	started time.Time
+	m       map[string]*jobStatus
+	errors  map[string]*errorStatus
+}
+
+func newJobs() jobsType {
+	return jobsType{
+		started: time.Now(),
+		m:       make(map[string]*jobStatus),
+		errors:  make(map[string]*errorStatus),
+	}
+}
+
+// register declares a job expected to run every interval, a known job keeps
+// its history.
+func (jobs *jobsType) register(name string, interval time.Duration) {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	if job, ok := jobs.m[name]; ok {
+		job.Interval = interval
+		return
+	}
+	jobs.m[name] = &jobStatus{Interval: interval}
+}
+
+func (jobs *jobsType) start(name string) {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	if job, ok := jobs.m[name]; ok {
+		job.LastRun = time.Now()
+	}
+}
+
+func (jobs *jobsType) finish(name string, err error) {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	job, ok := jobs.m[name]
+	if !ok {
+		return
+	}
+	job.LastCompleted = time.Now()
+	if err != nil {
+		job.LastError = err.Error()
+		return
+	}
+	job.LastError = ""
+	job.LastSuccess = job.LastCompleted
+	jobLastSuccess.WithLabelValues(name).Set(float64(job.LastSuccess.Unix()))
+}
+
+// setError remembers the last error talking to kind, e.g. imap or smtp.
+func (jobs *jobsType) setError(kind string, err error) {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	jobs.errors[kind] = &errorStatus{err.Error(), time.Now()}
+}
+
+// healthReport is the body of /healthz and /readyz.
+type healthReport struct {
+	OK     bool                    `json:"ok"`
+	Jobs   map[string]*jobStatus   `json:"jobs"`
+	Errors map[string]*errorStatus `json:"errors"`
+	// the jobs failing the check
+	Failing []string `json:"failing,omitempty"`
+}
+
+// report checks every job against multiple times its interval. Live jobs
+// have completed, ready jobs have succeeded within that time.
+func (jobs *jobsType) report(multiple int, ready bool) *healthReport {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	now := time.Now()
+	report := &healthReport{
+		OK:     true,
+		Jobs:   make(map[string]*jobStatus),
+		Errors: make(map[string]*errorStatus),
+	}
+	for name, job := range jobs.m {
+		copied := *job
+		report.Jobs[name] = &copied
+
+		last := job.LastCompleted
+		if ready {
+			last = job.LastSuccess
+		}
+		// a job which never ran is given time since start
+		if last.IsZero() {
+			last = jobs.started
+		}
+		if now.Sub(last) > time.Duration(multiple)*job.Interval {
+			report.OK = false
+			report.Failing = append(report.Failing, name)
+		}
+	}
+	for kind, e := range jobs.errors {
+		copied := *e
+		report.Errors[kind] = &copied
+	}
+
+	return report
+}
+
+func handleHealth(config *emailConfig, ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := jobs.report(config.healthMultiple, ready)
+
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
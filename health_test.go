@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_jobsReport(t *testing.T) {
+	jobs := newJobs()
+	jobs.started = time.Now().Add(-time.Hour)
+	jobs.register("fresh", time.Minute)
+	jobs.register("failing", time.Minute)
+	jobs.register("hung", time.Minute)
+
+	jobs.start("fresh")
+	jobs.finish("fresh", nil)
+	jobs.start("failing")
+	jobs.finish("failing", errors.New("smtp down"))
+	jobs.start("hung")
+
+	live := jobs.report(3, false)
+	if live.OK || !reflect.DeepEqual(live.Failing, []string{"hung"}) {
+		t.Errorf("live report failing %q, want only hung", live.Failing)
+	}
+	if live.Jobs["failing"].LastError != "smtp down" {
+		t.Errorf("failing job last error %q", live.Jobs["failing"].LastError)
+	}
+
+	ready := jobs.report(3, true)
+	failing := map[string]bool{}
+	for _, name := range ready.Failing {
+		failing[name] = true
+	}
+	if !reflect.DeepEqual(failing, map[string]bool{"failing": true, "hung": true}) {
+		t.Errorf("ready report failing %q, want failing and hung", ready.Failing)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// the width plain text digests are wrapped at
+const textWidth = 72
+
+// elements starting a new paragraph in plain text
+var textBlocks = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Blockquote: true, atom.Pre: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Ul: true, atom.Ol: true, atom.Table: true, atom.Tr: true,
+	atom.Section: true, atom.Article: true, atom.Figure: true, atom.Hr: true,
+}
+
+var (
+	spaceRun     = regexp.MustCompile(`[ \t\r\f\v]+`)
+	paragraphRun = regexp.MustCompile(`\n{3,}`)
+)
+
+// footnotes numbers the links of one plain text digest.
+type footnotes struct {
+	links []string
+}
+
+// ref returns the footnote of url, [n], numbering it on first use.
+func (f *footnotes) ref(url string) string {
+	for i, link := range f.links {
+		if link == url {
+			return "[" + strconv.Itoa(i+1) + "]"
+		}
+	}
+	f.links = append(f.links, url)
+	return "[" + strconv.Itoa(len(f.links)) + "]"
+}
+
+// htmlToText converts an HTML fragment to paragraphs of plain text separated
+// by blank lines, links become footnote references.
+func htmlToText(src string, notes *footnotes) string {
+	context := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(src), context)
+	if err != nil {
+		return src
+	}
+
+	var b strings.Builder
+	for _, n := range nodes {
+		writeText(&b, n, notes)
+	}
+
+	// tidy up whitespace line by line
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(spaceRun.ReplaceAllString(line, " "))
+	}
+	text := strings.Join(lines, "\n")
+	return strings.TrimSpace(paragraphRun.ReplaceAllString(text, "\n\n"))
+}
+
+func writeText(b *strings.Builder, n *html.Node, notes *footnotes) {
+	switch n.Type {
+	case html.TextNode:
+		b.WriteString(strings.ReplaceAll(n.Data, "\n", " "))
+		return
+	case html.ElementNode:
+	default:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			writeText(b, c, notes)
+		}
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head:
+		return
+	case atom.Br:
+		b.WriteString("\n")
+		return
+	case atom.Img:
+		if alt := attr(n, "alt"); alt != "" {
+			b.WriteString("[" + alt + "]")
+		}
+		return
+	case atom.Li:
+		b.WriteString("\n- ")
+	}
+
+	block := textBlocks[n.DataAtom]
+	if block {
+		b.WriteString("\n\n")
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writeText(b, c, notes)
+	}
+	if n.DataAtom == atom.A {
+		if href := attr(n, "href"); strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") {
+			b.WriteString(" " + notes.ref(href))
+		}
+	}
+	if block {
+		b.WriteString("\n\n")
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// wrapText wraps every line of text at width, continuing lines with indent.
+// Words longer than width are kept whole.
+func wrapText(text string, width int, indent string) string {
+	var out []string
+	for _, line := range strings.Split(text, "\n") {
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			out = append(out, "")
+			continue
+		}
+
+		current := indent + words[0]
+		for _, word := range words[1:] {
+			if utf8.RuneCountInString(current)+1+utf8.RuneCountInString(word) > width {
+				out = append(out, current)
+				current = indent + word
+				continue
+			}
+			current += " " + word
+		}
+		out = append(out, current)
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newHTTPServer returns the server of every http endpoint, listening on
+// config.httpAddr.
+func newHTTPServer(config *emailConfig) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/u/", handlePersonalFeed(config))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealth(config, false))
+	mux.HandleFunc("/readyz", handleHealth(config, true))
+	if config.adminToken != "" {
+		mux.HandleFunc("/admin/", handleAdmin(config))
+		mux.HandleFunc("/api/", handleAPI(config))
+	}
+
+	return &http.Server{
+		Addr:         config.httpAddr,
+		Handler:      mux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+}
+
+// startHTTP listens on config.httpAddr and serves every http endpoint until
+// shutdownHTTP is called. Binding fails right away, so a reload can keep the
+// running server.
+func startHTTP(config *emailConfig) (*http.Server, error) {
+	server := newHTTPServer(config)
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("http server listening on %s", server.Addr)
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Println("error http server", err)
+		}
+	}()
+	return server, nil
+}
+
+func shutdownHTTP(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("error http server shutdown", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func Test_restartHTTP(t *testing.T) {
+	freeAddr := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		return l.Addr().String()
+	}
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	server, err := startHTTP(&emailConfig{httpAddr: freeAddr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdownHTTP(server)
+
+	// a reload to an address in use keeps serving on the current one
+	if got := restartHTTP(server, &emailConfig{httpAddr: busy.Addr().String()}); got != server {
+		t.Fatalf("restart on a busy address replaced the server")
+	}
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	if err != nil {
+		t.Fatalf("current server stopped: %v", err)
+	}
+	resp.Body.Close()
+
+	// the same address is served by the new server
+	moved := restartHTTP(server, &emailConfig{httpAddr: server.Addr})
+	if moved == nil || moved == server {
+		t.Fatalf("restart on the same address returned %v", moved)
+	}
+	defer shutdownHTTP(moved)
+	resp, err = http.Get("http://" + moved.Addr + "/metrics")
+	if err != nil {
+		t.Fatalf("restarted server: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// image policies users can pick with the images command
+const (
+	imagesRemote = "remote"
+	imagesStrip  = "strip"
+	imagesEmbed  = "embed"
+)
+
+const imageTimeout = 15 * time.Second
+
+// images downloaded at once
+const imageFetchers = 4
+
+// images embedded in one digest at most, the others are stripped
+const maxInlineImages = 50
+
+// how long downloaded images, and failures, are kept
+const imageCacheTTL = 6 * time.Hour
+
+// bytes of images kept in imageCache, the oldest go first
+const imageCacheSize = 32 << 20
+
+func validImages(policy string) bool {
+	return policy == imagesRemote || policy == imagesStrip || policy == imagesEmbed
+}
+
+// imagesFor returns the image policy of user's digests.
+func imagesFor(config *emailConfig, user string) string {
+	if pref := userSubscriptions.pref(user); pref.Images != "" {
+		return pref.Images
+	}
+	return config.images
+}
+
+// inlineImage is an image attached to a digest, referenced by its cid.
+type inlineImage struct {
+	cid         string
+	contentType string
+	data        []byte
+}
+
+type cachedImage struct {
+	data        []byte
+	contentType string
+	err         error
+	fetched     time.Time
+}
+
+// imageCacheType keeps downloaded images, digests of many users often share
+// them.
+type imageCacheType struct {
+	sync.Mutex
+	m    map[string]*cachedImage
+	size int
+}
+
+var imageCache = imageCacheType{m: make(map[string]*cachedImage)}
+
+// fetch returns the images at urls, downloading the ones not cached.
+func (cache *imageCacheType) fetch(config *emailConfig, urls []string) map[string]*cachedImage {
+	res := make(map[string]*cachedImage)
+	var missing []string
+	cache.Lock()
+	for _, url := range urls {
+		if img, ok := cache.m[url]; ok && time.Since(img.fetched) < imageCacheTTL {
+			res[url] = img
+			continue
+		}
+		missing = append(missing, url)
+	}
+	cache.Unlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, imageFetchers)
+	for _, url := range missing {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			img := downloadImage(config, url, config.imageMaxSize*1024)
+			<-sem
+
+			mu.Lock()
+			res[url] = img
+			mu.Unlock()
+		}(url)
+	}
+	wg.Wait()
+
+	cache.Lock()
+	defer cache.Unlock()
+	for _, url := range missing {
+		cache.put(url, res[url])
+	}
+	return res
+}
+
+// put caches img, caller must hold the lock.
+func (cache *imageCacheType) put(url string, img *cachedImage) {
+	if old, ok := cache.m[url]; ok {
+		cache.size -= len(old.data)
+	}
+	cache.m[url] = img
+	cache.size += len(img.data)
+
+	for cache.size > imageCacheSize {
+		var oldest string
+		for url, img := range cache.m {
+			if oldest == "" || img.fetched.Before(cache.m[oldest].fetched) {
+				oldest = url
+			}
+		}
+		cache.size -= len(cache.m[oldest].data)
+		delete(cache.m, oldest)
+	}
+}
+
+// downloadImage gets the image at url unless it's larger than max bytes.
+func downloadImage(config *emailConfig, url string, max int) *cachedImage {
+	img := &cachedImage{fetched: time.Now()}
+
+	data, contentType, err := downloadFile(config, url, max)
+	if err != nil {
+		img.err = err
+		return img
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		img.err = fmt.Errorf("image %s: not an image but %s", url, contentType)
+		return img
+	}
+	img.data, img.contentType = data, contentType
+	return img
+}
+
+// downloadFile gets the file at url and its content type, unless it's larger
+// than max bytes. Feeds pick url, so it's guarded like webhooks.
+func downloadFile(config *emailConfig, url string, max int) ([]byte, string, error) {
+	resp, err := guardedClient(config, imageTimeout).Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(max)+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > max {
+		return nil, "", fmt.Errorf("%s: larger than %d bytes", url, max)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// inlineImages rewrites the remote images of the HTML body following policy.
+// With imagesEmbed they are downloaded and returned to be attached, within
+// config.imageMaxTotal, and the ones left over are stripped. Callers must not
+// hold userSubscriptions lock or subscription lock meanwhile. Stripped images
+// become a link to them named after their alt text.
+func inlineImages(config *emailConfig, body, policy string) (string, []*inlineImage) {
+	if policy != imagesStrip && policy != imagesEmbed {
+		return body, nil
+	}
+	// nothing is downloaded in dry run, the images stay remote
+	if policy == imagesEmbed && config.dryRun {
+		return body, nil
+	}
+
+	var fetched map[string]*cachedImage
+	if policy == imagesEmbed {
+		fetched = imageCache.fetch(config, imageURLs(body))
+	}
+
+	var b strings.Builder
+	var images []*inlineImage
+	embedded := make(map[string]*inlineImage)
+	total := 0
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			b.WriteString(raw)
+			continue
+		}
+
+		token := z.Token()
+		switch token.DataAtom {
+		case atom.Source:
+			// alternatives of a picture, its img is enough
+			if tokenAttr(token, "srcset") != "" {
+				continue
+			}
+		case atom.Img:
+			src := tokenAttr(token, "src")
+			if !remoteURL(src) {
+				if tokenAttr(token, "srcset") != "" {
+					token.Attr = setTokenAttr(token.Attr, "srcset", "")
+					b.WriteString(token.String())
+					continue
+				}
+				break
+			}
+
+			img, ok := embedded[src]
+			if !ok {
+				if cached := fetched[src]; cached != nil && cached.err == nil && total+len(cached.data) <= config.imageMaxTotal*1024 {
+					img = &inlineImage{cid: newOutboxID() + "@rss-email", contentType: cached.contentType, data: cached.data}
+					embedded[src] = img
+					images = append(images, img)
+					total += len(img.data)
+				}
+			}
+			if img == nil {
+				if alt := tokenAttr(token, "alt"); alt != "" {
+					b.WriteString(`<a href="` + html.EscapeString(src) + `">[` + html.EscapeString(alt) + `]</a>`)
+				}
+				continue
+			}
+
+			token.Attr = setTokenAttr(token.Attr, "src", "cid:"+img.cid)
+			token.Attr = setTokenAttr(token.Attr, "srcset", "")
+			b.WriteString(token.String())
+			continue
+		}
+		b.WriteString(raw)
+	}
+	return b.String(), images
+}
+
+// imageURLs returns the distinct remote image sources of the HTML body, up to
+// maxInlineImages.
+func imageURLs(body string) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	z := html.NewTokenizer(strings.NewReader(body))
+	for len(urls) < maxInlineImages {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := z.Token()
+		if src := tokenAttr(token, "src"); token.DataAtom == atom.Img && remoteURL(src) && !seen[src] {
+			seen[src] = true
+			urls = append(urls, src)
+		}
+	}
+	return urls
+}
+
+func remoteURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+func tokenAttr(token html.Token, key string) string {
+	for _, a := range token.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// setTokenAttr sets key to val in attrs, an empty val removes it.
+func setTokenAttr(attrs []html.Attribute, key, val string) []html.Attribute {
+	var res []html.Attribute
+	for _, a := range attrs {
+		if a.Key != key {
+			res = append(res, a)
+		}
+	}
+	if val != "" {
+		res = append(res, html.Attribute{Key: key, Val: val})
+	}
+	return res
+}
+
+// relatedBody returns a multipart/related body of the quoted-printable HTML
+// body followed by images, and its content type.
+func relatedBody(body string, images []*inlineImage) (string, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentHTML+`; charset="UTF-8"`)
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := io.WriteString(part, body); err != nil {
+		return "", "", err
+	}
+
+	for _, img := range images {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", img.contentType)
+		h.Set("Content-Transfer-Encoding", "base64")
+		h.Set("Content-ID", "<"+img.cid+">")
+		h.Set("Content-Disposition", "inline")
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return "", "", err
+		}
+		if err := writeBase64(part, img.data); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return buf.String(), `multipart/related; boundary="` + w.Boundary() + `"; type="` + contentHTML + `"`, nil
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func Test_inlineImages(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n0000")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.png":
+			w.Write(png)
+		case "/big.png":
+			w.Write(bytes.Repeat(png, 1024))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	body := `<p><img src="` + ts.URL + `/a.png" srcset="` + ts.URL + `/a2.png 2x">` +
+		`<img src="` + ts.URL + `/a.png">` +
+		`<img src="` + ts.URL + `/missing.png" alt="chart">` +
+		`<img src="` + ts.URL + `/big.png" width="1"></p>`
+	config := &emailConfig{from: "rss@example.com", imageMaxSize: 1, imageMaxTotal: 1, allowPrivate: []string{"127.0.0.1"}}
+
+	// feeds can't point downloads at the deployment's networks
+	if _, _, err := downloadFile(&emailConfig{}, ts.URL+"/a.png", 1024); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("download from loopback error %v, want %v", err, errPrivateAddress)
+	}
+	// nor does dry run download, the images stay remote
+	if got, images := inlineImages(&emailConfig{dryRun: true}, body, imagesEmbed); got != body || images != nil {
+		t.Errorf("embed in dry run: %q, %d images", got, len(images))
+	}
+
+	got, images := inlineImages(config, body, imagesStrip)
+	if want := `<p><a href="` + ts.URL + `/missing.png">[chart]</a></p>`; got != want || images != nil {
+		t.Errorf("strip: %q, %d images, want %q", got, len(images), want)
+	}
+
+	got, images = inlineImages(config, body, imagesEmbed)
+	if len(images) != 1 || !bytes.Equal(images[0].data, png) || images[0].contentType != "image/png" {
+		t.Fatalf("embed: %d images, want a.png", len(images))
+	}
+	cid := `src="cid:` + images[0].cid + `"`
+	if strings.Count(got, cid) != 2 || strings.Contains(got, "srcset") || strings.Contains(got, "big.png") {
+		t.Errorf("embed: %q", got)
+	}
+
+	if got, _ := inlineImages(config, body, imagesRemote); got != body {
+		t.Errorf("remote: %q", got)
+	}
+
+	// the message carries the html and the image as related parts
+	qp, err := toQuotedPrintable(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	related, contentType, err := relatedBody(qp, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := composeMessage(config, "a@example.com", feedSubject, contentType, related)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" || msg.Header.Get("Content-Transfer-Encoding") != "" {
+		t.Fatalf("content type %q, %v", msg.Header.Get("Content-Type"), err)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := r.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	html, _ := ioutil.ReadAll(part)
+	if !strings.Contains(string(html), cid) {
+		t.Errorf("html part %q", html)
+	}
+	part, err = r.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.Header.Get("Content-ID") != "<"+images[0].cid+">" || part.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("image part header %v", part.Header)
+	}
+}
+
+func Test_sendSubscriptionDownloadsUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rss-email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setDataDir(dir)
+	defer setDataDir("/rss-email")
+
+	// the image server waits for the locks a download must not hold
+	var locked bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		free := make(chan struct{})
+		go func() {
+			userSubscriptions.Lock()
+			subscription.Lock()
+			subscription.Unlock()
+			userSubscriptions.Unlock()
+			close(free)
+		}()
+		select {
+		case <-free:
+		case <-time.After(time.Second):
+			locked = true
+		}
+		w.Write([]byte("\x89PNG\r\n\x1a\n0000"))
+	}))
+	defer ts.Close()
+
+	userSubscriptions = newUserSubscriptions()
+	subscription = newSubscription()
+	outbox = newOutbox()
+	defer func() {
+		userSubscriptions = newUserSubscriptions()
+		subscription = newSubscription()
+		outbox = newOutbox()
+	}()
+	subscribeUser("a@example.com", []string{"https://a.example.com/feed"})
+	userSubscriptions.setPref("a@example.com").Images = imagesEmbed
+	published := time.Date(2020, 4, 23, 10, 0, 0, 0, time.UTC)
+	subscription.m["https://a.example.com/feed"] = &urlInfo{lastUpdate: time.Now(), feed: &gofeed.Feed{Title: "A", Items: []*gofeed.Item{
+		{Title: "a1", Link: "https://a.example.com/1", PublishedParsed: &published, Content: `<img src="` + ts.URL + `/unlocked.png">`},
+	}}}
+
+	config := &emailConfig{from: "rss@example.com", imageMaxSize: 1, imageMaxTotal: 1, allowPrivate: []string{"127.0.0.1"}}
+	if err := sendSubscription(config); err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Error("image downloaded holding the subscription locks")
+	}
+	if outbox.depth() != 1 || !strings.Contains(string(outbox.Pending[0].Data), "multipart/related") {
+		t.Errorf("outbox holds %d messages, want the digest with its image", outbox.depth())
+	}
+}
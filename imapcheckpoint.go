@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+var checkpointFilePath = path.Join("/", "rss-email", "imap")
+
+// mailboxCheckpoint remembers up to which message a mailbox has been handled.
+// UIDs are only meaningful as long as the mailbox keeps its UIDVALIDITY.
+type mailboxCheckpoint struct {
+	UIDValidity uint32
+	LastUID     uint32
+}
+
+// mailboxCheckpoints maps mailbox name to its checkpoint, it's only accessed
+// while holding userSubscriptions lock.
+type mailboxCheckpoints map[string]*mailboxCheckpoint
+
+func newMailboxCheckpoints() mailboxCheckpoints {
+	return make(mailboxCheckpoints)
+}
+
+// get returns the checkpoint of mailbox, reset when uidValidity has changed.
+func (checkpoints mailboxCheckpoints) get(mailbox string, uidValidity uint32) *mailboxCheckpoint {
+	checkpoint, ok := checkpoints[mailbox]
+	if !ok || checkpoint.UIDValidity != uidValidity {
+		checkpoint = &mailboxCheckpoint{UIDValidity: uidValidity}
+		checkpoints[mailbox] = checkpoint
+	}
+	return checkpoint
+}
+
+// save checkpoints to disc.
+func (checkpoints mailboxCheckpoints) saveToDisk() error {
+	dir, _ := path.Split(checkpointFilePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(checkpointFilePath, b, 0600)
+}
+
+// restore checkpoints from disc.
+func (checkpoints mailboxCheckpoints) restoreFromDisk() error {
+	b, err := ioutil.ReadFile(checkpointFilePath)
+	if os.IsNotExist(err) {
+		log.Println("no imap checkpoint to restore from")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, &checkpoints)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func Test_mailboxCheckpoints(t *testing.T) {
+	checkpoints := newMailboxCheckpoints()
+	checkpoints["INBOX"] = &mailboxCheckpoint{UIDValidity: 1, LastUID: 10}
+
+	// get in order, then advance the checkpoint to next
+	tests := []struct {
+		mailbox     string
+		uidValidity uint32
+		want        uint32
+		next        uint32
+	}{
+		{"INBOX", 1, 10, 12},
+		{"INBOX", 1, 12, 12},
+		{"Feeds", 1, 0, 3},
+		// the mailbox was recreated, its uids start over
+		{"INBOX", 2, 0, 1},
+		{"INBOX", 2, 1, 1},
+		{"Feeds", 1, 3, 3},
+	}
+	for _, tt := range tests {
+		checkpoint := checkpoints.get(tt.mailbox, tt.uidValidity)
+		if checkpoint.LastUID != tt.want || checkpoint.UIDValidity != tt.uidValidity {
+			t.Errorf("get(%q, %d) = %+v, want LastUID %d", tt.mailbox, tt.uidValidity, *checkpoint, tt.want)
+		}
+		checkpoint.LastUID = tt.next
+	}
+}
+
+// imapMailbox answers like an imap server holding one mailbox of unseen
+// messages by uid, messages without body fail to process. UIDs stored \Seen
+// are added to stored.
+func imapMailbox(uidValidity uint32, messages map[uint32]string, stored *[]uint32) func(line string) string {
+	var uids []uint32
+	for uid := range messages {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	return func(line string) string {
+		fields := strings.Fields(line)
+		tag, command := fields[0], strings.ToUpper(fields[1])
+		if command == "UID" {
+			command += " " + strings.ToUpper(fields[2])
+		}
+
+		var untagged string
+		switch command {
+		case "SELECT":
+			untagged = fmt.Sprintf("* %d EXISTS\r\n* OK [UIDVALIDITY %d] uids valid\r\n", len(uids), uidValidity)
+		case "UID SEARCH":
+			// all unseen, whatever the range, like n:* matching the last uid
+			untagged = "* SEARCH"
+			for _, uid := range uids {
+				untagged += fmt.Sprintf(" %d", uid)
+			}
+			untagged += "\r\n"
+		case "UID FETCH":
+			set, _ := imap.ParseSeqSet(fields[3])
+			for i, uid := range uids {
+				if !set.Contains(uid) {
+					continue
+				}
+				body := messages[uid]
+				if body == "" {
+					untagged += fmt.Sprintf("* %d FETCH (UID %d)\r\n", i+1, uid)
+					continue
+				}
+				untagged += fmt.Sprintf("* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", i+1, uid, len(body), body)
+			}
+		case "UID STORE":
+			set, _ := imap.ParseSeqSet(fields[3])
+			for _, uid := range uids {
+				if set.Contains(uid) {
+					*stored = append(*stored, uid)
+				}
+			}
+		case "LOGOUT":
+			untagged = "* BYE bye\r\n"
+		}
+		return untagged + tag + " OK done\r\n"
+	}
+}
+
+func Test_fetchFromBoxCheckpoint(t *testing.T) {
+	command := "From: a@example.com\r\nSubject: rss-email list\r\n\r\n"
+	tests := []struct {
+		name         string
+		before       mailboxCheckpoint
+		uidValidity  uint32
+		dryRun       bool
+		wantLastUID  uint32
+		wantSaved    bool
+		wantStored   []uint32
+		wantMessages int
+	}{
+		// 6 fails, the checkpoint stops before it though 7 is handled
+		{"handled messages only", mailboxCheckpoint{1, 4}, 1, false, 5, true, []uint32{5, 7}, 2},
+		{"past the checkpoint only", mailboxCheckpoint{1, 5}, 1, false, 5, true, []uint32{7}, 1},
+		{"uidvalidity changed", mailboxCheckpoint{1, 100}, 2, false, 5, true, []uint32{5, 7}, 2},
+		{"dry run", mailboxCheckpoint{1, 4}, 1, true, 4, false, nil, 0},
+	}
+	for _, tt := range tests {
+		dir := keepState(t)
+		before := tt.before
+		checkpoints["INBOX"] = &before
+
+		var stored []uint32
+		addr, _ := lineServer(t, "* OK [CAPABILITY IMAP4rev1] fake\r\n", imapMailbox(tt.uidValidity, map[uint32]string{
+			5: command,
+			6: "",
+			7: command,
+		}, &stored))
+		config := &emailConfig{
+			from:       "rss@example.com",
+			imapServer: addr,
+			imapTLS:    tlsPlain,
+			dryRun:     tt.dryRun,
+			dryRunDir:  filepath.Join(dir, "dry-run"),
+		}
+		c, err := dialIMAP(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Login("rss", "secret"); err != nil {
+			t.Fatal(err)
+		}
+		if err := fetchFromBox(config, c, "INBOX"); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		c.Logout()
+
+		if got := checkpoints["INBOX"]; got.LastUID != tt.wantLastUID || got.UIDValidity != tt.uidValidity {
+			t.Errorf("%s: checkpoint %+v, want LastUID %d", tt.name, *got, tt.wantLastUID)
+		}
+		saved := newMailboxCheckpoints()
+		if err := saved.restoreFromDisk(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := saved["INBOX"]; ok != tt.wantSaved {
+			t.Errorf("%s: checkpoint saved %v, want %v", tt.name, ok, tt.wantSaved)
+		} else if ok && *saved["INBOX"] != *checkpoints["INBOX"] {
+			t.Errorf("%s: saved checkpoint %+v, want %+v", tt.name, *saved["INBOX"], *checkpoints["INBOX"])
+		}
+		if fmt.Sprint(stored) != fmt.Sprint(tt.wantStored) {
+			t.Errorf("%s: stored \\Seen on %v, want %v", tt.name, stored, tt.wantStored)
+		}
+		if got := outbox.depth(); got != tt.wantMessages {
+			t.Errorf("%s: %d replies queued, want %d", tt.name, got, tt.wantMessages)
+		}
+		if _, err := os.Stat(config.dryRunDir); (err == nil) != tt.dryRun {
+			t.Errorf("%s: dry run output %v", tt.name, err)
+		}
+	}
+}
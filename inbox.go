@@ -0,0 +1,37 @@
+package main
+
+// the protocols the command inbox can be read with
+const (
+	inboxIMAP = "imap"
+	inboxPOP3 = "pop3"
+)
+
+// commandInbox is the mailbox users send their commands to. Every new message
+// is handed to processRaw, whatever the protocol.
+type commandInbox interface {
+	// watch handles new messages until stop is closed
+	watch(stop <-chan struct{})
+}
+
+type imapInbox struct {
+	config *emailConfig
+}
+
+func (inbox *imapInbox) watch(stop <-chan struct{}) {
+	watchInbox(inbox.config, stop)
+}
+
+type pop3Inbox struct {
+	config *emailConfig
+}
+
+func (inbox *pop3Inbox) watch(stop <-chan struct{}) {
+	watchPOP3(inbox.config, stop)
+}
+
+func newCommandInbox(config *emailConfig) commandInbox {
+	if config.inbox == inboxPOP3 {
+		return &pop3Inbox{config}
+	}
+	return &imapInbox{config}
+}
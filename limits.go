@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/mail"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+)
+
+// overflow items listed as headlines per feed, the rest is only counted
+const maxOverflowHeadlines = 20
+
+// the size an item takes in a digest besides its content, about
+const itemOverhead = 200
+
+// elements without an end tag, never left open by truncateHTML
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true,
+	"img": true, "input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+const responseLimitUsage = "<div>usage: limit items|total|truncate|size N, 0 for the default</div>"
+
+// digestLimits bounds the length of one digest, zero is no limit.
+type digestLimits struct {
+	// full items per feed and in the whole digest, the others are headlines
+	FeedItems int
+	Items     int
+	// characters of text kept of every item's content
+	Truncate int
+	// bytes of item content in the whole digest, about
+	Size int
+}
+
+// digestFeed is a feed of a digest, the items beyond its limits are listed
+// in More as headlines and counted in Omitted beyond those.
+type digestFeed struct {
+	*gofeed.Feed
+	More    []*gofeed.Item
+	Omitted int
+	// the user's tag of the feed, its anchor in the table of contents and
+	// its count of new items, see sortDigest
+	Tag    string
+	Anchor string
+	Count  int
+
+	url string
+
+	// full items of this feed, overriding digestLimits.FeedItems
+	maxItems int
+	// attach the enclosures of the items, see digestAttachments
+	attach bool
+}
+
+// limitsFor returns the limits of user's digests, the user's preferences
+// override the deployment's flags.
+func limitsFor(config *emailConfig, user string) digestLimits {
+	pref := userSubscriptions.pref(user)
+	limits := digestLimits{config.maxFeedItems, config.maxItems, config.truncate, config.maxDigestSize * 1024}
+	if pref.MaxFeedItems != 0 {
+		limits.FeedItems = pref.MaxFeedItems
+	}
+	if pref.MaxItems != 0 {
+		limits.Items = pref.MaxItems
+	}
+	if pref.Truncate != 0 {
+		limits.Truncate = pref.Truncate
+	}
+	if pref.MaxDigestSize != 0 {
+		limits.Size = pref.MaxDigestSize * 1024
+	}
+	return limits
+}
+
+// limitDigest applies limits to the feeds of param, in order: items per feed,
+// total items, truncation and size. Items are copied before they are
+// truncated, feeds share theirs with the fetched ones.
+func limitDigest(param *bodyParam, limits digestLimits) {
+	var total, size int
+	for _, feed := range param.Feeds {
+		limit := feed.maxItems
+		if limit == 0 {
+			limit = limits.FeedItems
+		}
+
+		var items, more []*gofeed.Item
+		for i, item := range feed.Items {
+			if (limit > 0 && i >= limit) || (limits.Items > 0 && total >= limits.Items) ||
+				(limits.Size > 0 && size >= limits.Size) {
+				more = append(more, item)
+				continue
+			}
+
+			if limits.Truncate > 0 {
+				item = truncateItem(item, limits.Truncate)
+			}
+			items = append(items, item)
+			total++
+			size += itemOverhead + len(item.Title) + len(itemContent(item.Content, item.Description))
+		}
+
+		feed.Items = items
+		feed.More = append(more, feed.More...)
+		if len(feed.More) > maxOverflowHeadlines {
+			feed.Omitted += len(feed.More) - maxOverflowHeadlines
+			feed.More = feed.More[:maxOverflowHeadlines]
+		}
+	}
+}
+
+// truncateItem returns a copy of item with its content and description cut
+// after n characters, linking to the item where they are cut.
+func truncateItem(item *gofeed.Item, n int) *gofeed.Item {
+	res := new(gofeed.Item)
+	*res = *item
+
+	more := ""
+	if item.Link != "" {
+		more = ` <a href="` + html.EscapeString(item.Link) + `">more</a>`
+	}
+	res.Content, _ = truncateHTML(item.Content, n, more)
+	res.Description, _ = truncateHTML(item.Description, n, more)
+	return res
+}
+
+// truncateHTML cuts src after n characters of text, at a word boundary and
+// never inside a tag, appends tail and closes the elements left open. It
+// reports whether src was cut.
+func truncateHTML(src string, n int, tail string) (string, bool) {
+	z := html.NewTokenizer(strings.NewReader(src))
+	var b strings.Builder
+	var open []string
+	count := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			// the end of src, or html too broken to tell
+			return src, false
+		case html.TextToken:
+			text := []rune(string(z.Text()))
+			if count+len(text) <= n {
+				b.WriteString(html.EscapeString(string(text)))
+				count += len(text)
+				continue
+			}
+
+			end := n - count
+			for end > 0 && !unicode.IsSpace(text[end]) {
+				end--
+			}
+			if end == 0 {
+				end = n - count
+			}
+			b.WriteString(html.EscapeString(strings.TrimRightFunc(string(text[:end]), unicode.IsSpace)))
+			b.WriteString("…" + tail)
+			for i := len(open) - 1; i >= 0; i-- {
+				b.WriteString("</" + open[i] + ">")
+			}
+			return b.String(), true
+		case html.StartTagToken:
+			b.Write(z.Raw())
+			name, _ := z.TagName()
+			if !voidElements[string(name)] {
+				open = append(open, string(name))
+			}
+		case html.EndTagToken:
+			b.Write(z.Raw())
+			name, _ := z.TagName()
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == string(name) {
+					open = open[:i]
+					break
+				}
+			}
+		default:
+			b.Write(z.Raw())
+		}
+	}
+}
+
+// runLimitCommand sets one of user's digest limits from the limit command
+// argument, e.g. "items 5", and returns the response body. Item caps apply to
+// the subscribed urls listed in the body of msg if any.
+func runLimitCommand(config *emailConfig, user string, userSubscription *userSubscriptionType, msg *mail.Message, arg string) string {
+	fields := strings.Fields(arg)
+	if len(fields) == 2 {
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 {
+			return "<div>not a number: " + html.EscapeString(fields[1]) + "</div>"
+		}
+
+		pref := userSubscriptions.setPref(user)
+		switch fields[0] {
+		case "items":
+			var feeds []string
+			if slurp, err := parseMultipart(msg); err == nil {
+				for _, url := range normalizeURLs(extractURLs(slurp)) {
+					if info, ok := (*userSubscription)[url]; ok {
+						info.MaxItems = n
+						feeds = append(feeds, url)
+					}
+				}
+			}
+			if len(feeds) == 0 {
+				pref.MaxFeedItems = n
+			}
+		case "total":
+			pref.MaxItems = n
+		case "truncate":
+			pref.Truncate = n
+		case "size":
+			pref.MaxDigestSize = n
+		default:
+			return responseLimitUsage
+		}
+	} else if len(fields) != 0 {
+		return responseLimitUsage
+	}
+
+	limits := limitsFor(config, user)
+	str := "<div>full items per feed: " + limitString(limits.FeedItems) + "</div>"
+	for url, info := range *userSubscription {
+		if info.MaxItems != 0 {
+			str += "<div>full items of " + html.EscapeString(url) + ": " + strconv.Itoa(info.MaxItems) + "</div>"
+		}
+	}
+	str += "<div>full items per digest: " + limitString(limits.Items) + "</div>"
+	str += "<div>characters per item: " + limitString(limits.Truncate) + "</div>"
+	str += "<div>kilobytes per digest: " + limitString(limits.Size/1024) + "</div>"
+	return str
+}
+
+func limitString(n int) string {
+	if n == 0 {
+		return "no limit"
+	}
+	return strconv.Itoa(n)
+}
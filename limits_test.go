@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func Test_truncateHTML(t *testing.T) {
+	tests := []struct {
+		src  string
+		n    int
+		want string
+		cut  bool
+	}{
+		{"<p>short</p>", 10, "<p>short</p>", false},
+		{"<p>one two three</p>", 9, "<p>one two…</p>", true},
+		{`<div><a href="https://x/?a=1&amp;b=2">one two</a> three</div>`, 5, `<div><a href="https://x/?a=1&amp;b=2">one…</a></div>`, true},
+		{"<p>one<br>two three four</p>", 8, "<p>one<br>two…</p>", true},
+		// a single long word is cut where it is
+		{"<b>abcdefghij</b>", 4, "<b>abcd…</b>", true},
+		{"ab &amp; cd ef", 7, "ab &amp; cd…", true},
+	}
+	for _, tt := range tests {
+		got, cut := truncateHTML(tt.src, tt.n, "")
+		if got != tt.want || cut != tt.cut {
+			t.Errorf("truncateHTML(%q, %d) = %q, %v, want %q, %v", tt.src, tt.n, got, cut, tt.want, tt.cut)
+		}
+	}
+}
+
+func Test_limitDigest(t *testing.T) {
+	published := time.Date(2020, 4, 23, 10, 0, 0, 0, time.UTC)
+	newFeed := func(name string, n int) *digestFeed {
+		feed := &gofeed.Feed{Title: name, Link: "https://" + name}
+		for i := 0; i < n; i++ {
+			feed.Items = append(feed.Items, &gofeed.Item{
+				Title:           name + strconv.Itoa(i),
+				Link:            "https://" + name + "/" + strconv.Itoa(i),
+				Content:         "<p>" + strings.Repeat("word ", 100) + "</p>",
+				PublishedParsed: &published,
+			})
+		}
+		return &digestFeed{Feed: feed}
+	}
+
+	a, b, c := newFeed("a", 3), newFeed("b", 30), newFeed("c", 2)
+	a.maxItems = 1
+	shared := b.Items[0]
+	param := &bodyParam{Feeds: []*digestFeed{a, b, c}}
+	sortDigest(param, sortTitle)
+	limitDigest(param, digestLimits{FeedItems: 2, Items: 3, Truncate: 20})
+
+	if len(a.Items) != 1 || len(a.More) != 2 {
+		t.Errorf("feed a has %d items and %d more, want 1 and 2", len(a.Items), len(a.More))
+	}
+	if len(b.Items) != 2 || len(b.More) != maxOverflowHeadlines || b.Omitted != 28-maxOverflowHeadlines {
+		t.Errorf("feed b has %d items, %d more and %d omitted", len(b.Items), len(b.More), b.Omitted)
+	}
+	// the total is reached
+	if len(c.Items) != 0 || len(c.More) != 2 {
+		t.Errorf("feed c has %d items and %d more, want 0 and 2", len(c.Items), len(c.More))
+	}
+	if want := `<p>word word word word… <a href="https://b/0">more</a></p>`; b.Items[0].Content != want {
+		t.Errorf("truncated content %q, want %q", b.Items[0].Content, want)
+	}
+	if shared.Content == b.Items[0].Content {
+		t.Error("truncation changed the fetched item")
+	}
+
+	templateCache.reset()
+	got, err := parsefeed(&emailConfig{}, "full", param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<a href="https://c/1">c1</a>`, "and 8 more at"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("digest lacks %q", want)
+		}
+	}
+
+	// the size budget keeps at least one item
+	d := newFeed("d", 5)
+	limitDigest(&bodyParam{Feeds: []*digestFeed{d}}, digestLimits{Size: 1000})
+	if len(d.Items) != 2 || len(d.More) != 3 {
+		t.Errorf("feed d has %d items and %d more, want 2 and 3", len(d.Items), len(d.More))
+	}
+}
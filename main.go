@@ -5,91 +5,221 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
-// the interval checking email inbox, in seconds
-const fetchemailInterval = 5 * 60
-
-// the interval fetching RSS feed
-const fetchfeedInterval = 30 * 60
-
-// the interval printing running info
-const statsInterval = 20
-
 type emailConfig struct {
 	from       string
 	smtpServer string
 	imapServer string
+	pop3Server string
+	inbox      string
 	username   string
 	password   string
+
+	delivery string
+	maildir  string
+	mbox     string
+
+	appendFolder string
+	appendPerTag bool
+
+	webhookSecret string
+	// hosts, addresses and networks webhooks, images and enclosures may
+	// reach although they are loopback, private or link-local
+	allowPrivate []string
+
+	httpAddr       string
+	publicURL      string
+	adminToken     string
+	healthMultiple int
+
+	smtpPerMinute int
+	smtpPerDay    int
+
+	smtpTLS            string
+	imapTLS            string
+	pop3TLS            string
+	tlsCA              string
+	tlsCert            string
+	tlsKey             string
+	insecureSkipVerify bool
+
+	mailboxes        []string
+	scanJunk         bool
+	processedMailbox string
+
+	// the interval checking every email inbox. New messages in the first
+	// mailbox are handled as soon as they arrive.
+	fetchemailInterval time.Duration
+	// the interval fetching RSS feed
+	fetchfeedInterval time.Duration
+	// the interval sending digests, in minutes
+	sendemailInterval int
+	// the interval printing running info
+	statsInterval time.Duration
+	// the interval draining the outbox
+	outboxInterval time.Duration
+
+	// the directory of every state file
+	dataDir string
+	// the directory of digest templates overriding the embedded ones
+	templateDir string
+
+	// write messages to dryRunDir instead of sending them, leaving feed and
+	// inbox state alone
+	dryRun    bool
+	dryRunDir string
+
+	// default digest limits, see digestLimits
+	maxFeedItems  int
+	maxItems      int
+	truncate      int
+	maxDigestSize int
+
+	// default image policy of digests and the kilobytes of images embedded
+	images        string
+	imageMaxSize  int
+	imageMaxTotal int
+
+	// the kilobytes of enclosures attached to digests of feeds opting in
+	attachMaxSize  int
+	attachMaxTotal int
 }
 
 var userSubscriptions = newUserSubscriptions()
 var subscription = newSubscription()
+var outbox = newOutbox()
+var checkpoints = newMailboxCheckpoints()
+var pop3Seen = newPOP3Seen()
+var jobs = newJobs()
 
 func main() {
-	var config emailConfig
-	var sendemailInterval int
-
-	flag.StringVar(&config.from, "email", "", "`email` address serving rss-email service")
-	flag.StringVar(&config.smtpServer, "smtpServer", "", "smtp mail relay, `server[:port]`")
-	flag.StringVar(&config.imapServer, "imapServer", "", "imap server, `server[:port]`")
-	flag.StringVar(&config.username, "username", "", "authentication `user` (for SMTP/IMAP authentication)")
-	flag.StringVar(&config.password, "password", "", "authentication `password` (for SMTP/IMAP authentication)")
-
-	flag.IntVar(&sendemailInterval, "sendemailInterval", 10, "specify email sending interval, in `minutes`")
-
-	flag.Parse()
+	config, fs, err := parseConfig(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+	setDataDir(config.dataDir)
 
-	if err := verifyConfig(&config); err != nil {
-		flag.Usage()
+	if fs.NArg() > 0 {
+		if err := runCommand(config, fs.Args(), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
+
+	if err := verifyConfig(config); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		fs.Usage()
+		os.Exit(2)
+	}
 	if err := userSubscriptions.restoreFromDisk(); err != nil {
 		log.Panic("error restore from disk", err)
 	}
 	log.Print("user info restored from file")
+	if err := outbox.restoreFromDisk(); err != nil {
+		log.Panic("error restore outbox from disk", err)
+	}
+	if err := checkpoints.restoreFromDisk(); err != nil {
+		log.Panic("error restore imap checkpoint from disk", err)
+	}
+	if err := pop3Seen.restoreFromDisk(); err != nil {
+		log.Panic("error restore pop3 state from disk", err)
+	}
 
-	fetchemailTicker := time.NewTicker(fetchemailInterval * time.Second)
-	fetchfeedTicker := time.NewTicker(fetchfeedInterval * time.Second)
-	sendemailTicker := time.NewTicker(time.Duration(sendemailInterval) * time.Minute)
-	statsTicker := time.NewTicker(statsInterval * time.Second)
-	defer fetchemailTicker.Stop()
-	defer fetchfeedTicker.Stop()
-	defer sendemailTicker.Stop()
-	defer statsTicker.Stop()
+	tick := newTickers(config)
+	defer func() { tick.stop() }()
+	registerJobs(config)
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// make sure all goroutines finish executing when main goroutine is adout to exit
 	var wg sync.WaitGroup
 
+	// the inbox is watched for the whole lifetime, restarted on reload
+	inboxConfigs := make(chan *emailConfig, 1)
+	inboxDone := superviseInbox(config, inboxConfigs)
+
+	var httpServer *http.Server
+	if config.httpAddr != "" {
+		var err error
+		if httpServer, err = startHTTP(config); err != nil {
+			log.Panicln("error http server", err)
+		}
+	}
+
 	// only one job each type is executing
 	var statsRunning = false
-	var fetchemailRunning = false
-	var fetchfeedRunning = false
 	var sendemailRunning = false
+	var outboxRunning = false
 	for {
 		select {
 		case signal := <-signalChan:
+			if signal == syscall.SIGHUP {
+				newConfig, _, err := parseConfig(os.Args[1:], flag.ContinueOnError)
+				if err == nil {
+					err = verifyConfig(newConfig)
+				}
+				if err != nil {
+					log.Println("error reload configuration, keeping the current one:", err)
+					continue
+				}
+				// the state in memory belongs to the current files
+				if newConfig.dataDir != config.dataDir {
+					log.Println("dataDir changes on restart only")
+					newConfig.dataDir = config.dataDir
+				}
+				config = newConfig
+
+				templateCache.reset()
+				tick.stop()
+				tick = newTickers(config)
+				registerJobs(config)
+
+				// reconnect with the new credentials
+				restartInbox(inboxConfigs, config)
+				httpServer = restartHTTP(httpServer, config)
+
+				log.Println("configuration reloaded")
+				continue
+			}
+
 			fmt.Printf("signal %v received, waiting goroutines finish\n", signal)
+			close(inboxConfigs)
+			<-inboxDone
+			if httpServer != nil {
+				shutdownHTTP(httpServer)
+			}
 			wg.Wait()
 
+			if config.dryRun {
+				log.Println("dry run: user info not saved")
+				os.Exit(0)
+			}
 			if err := userSubscriptions.saveToDisk(); err != nil {
 				log.Panicln("error save to disk")
 			}
 			log.Println("user info saved to disk")
 
+			outbox.Lock()
+			if err := outbox.saveToDisk(); err != nil {
+				log.Panicln("error save outbox to disk")
+			}
+			outbox.Unlock()
+
 			os.Exit(0)
-		case <-statsTicker.C:
+		case <-tick.stats.C:
+			wg.Add(1)
 			go func() {
-				wg.Add(1)
 				defer wg.Done()
 
 				if statsRunning {
@@ -104,98 +234,349 @@ func main() {
 				subscription.RLock()
 				defer func() { subscription.RUnlock() }()
 
+				jobs.start("stats")
 				log.Printf("user count: %v, subscription count: %v\n", len(userSubscriptions.m), len(subscription.m))
+				jobs.finish("stats", nil)
 			}()
-		case <-fetchemailTicker.C:
-			go func() {
-				wg.Add(1)
+		case <-tick.fetchfeed.C:
+			wg.Add(1)
+			go func(config *emailConfig) {
 				defer wg.Done()
 
-				if fetchemailRunning {
-					return
-				}
-				fetchemailRunning = true
-				defer func() { fetchemailRunning = false }()
-
-				userSubscriptions.Lock()
-				defer func() { userSubscriptions.Unlock() }()
-
-				log.Println("fetchemail ...")
-				if err := fetchemail(&config); err != nil {
+				if err := runFetchfeed(config); err != nil && err != errFetchRunning {
 					log.Println(err)
 				}
-
-				if err := userSubscriptions.saveToDisk(); err != nil {
-					log.Panicln("error save to disk")
-				}
-				log.Println("user info saved to disk")
-			}()
-		case <-fetchfeedTicker.C:
-			go func() {
-				wg.Add(1)
+			}(config)
+		case <-tick.sendemail.C:
+			wg.Add(1)
+			go func(config *emailConfig) {
 				defer wg.Done()
 
-				if fetchfeedRunning {
+				if sendemailRunning {
 					return
 				}
-				fetchfeedRunning = true
-				defer func() { fetchfeedRunning = false }()
-
-				for _, v := range userSubscriptions.m {
-					for url := range *v {
-						if _, ok := subscription.m[url]; !ok {
-							subscription.m[url] = newURLInfo()
-						}
-					}
-				}
+				sendemailRunning = true
+				defer func() { sendemailRunning = false }()
 
-				log.Println("fetchfeed ...")
-				if err := fetchfeed(&config); err != nil {
+				jobs.start("sendemail")
+				log.Println("sendemail ...")
+				err := sendSubscription(config)
+				if err != nil {
 					log.Println(err)
 				}
-			}()
-		case <-sendemailTicker.C:
-			go func() {
-				wg.Add(1)
+				jobs.finish("sendemail", err)
+			}(config)
+		case <-tick.outbox.C:
+			wg.Add(1)
+			go func(config *emailConfig) {
 				defer wg.Done()
 
-				if sendemailRunning {
+				if outboxRunning {
 					return
 				}
-				sendemailRunning = true
-				defer func() { sendemailRunning = false }()
+				outboxRunning = true
+				defer func() { outboxRunning = false }()
 
-				userSubscriptions.Lock()
-				defer func() { userSubscriptions.Unlock() }()
-
-				subscription.RLock()
-				defer func() { subscription.RUnlock() }()
-
-				log.Println("sendemail ...")
-				if err := sendSubscription(&config); err != nil {
+				jobs.start("outbox")
+				err := outbox.drain(config)
+				if err != nil {
 					log.Println(err)
 				}
-			}()
+				jobs.finish("outbox", err)
+			}(config)
+		}
+
+	}
+}
+
+// tickers drive the periodic jobs of main.
+type tickers struct {
+	fetchfeed *time.Ticker
+	sendemail *time.Ticker
+	stats     *time.Ticker
+	outbox    *time.Ticker
+}
+
+func newTickers(config *emailConfig) *tickers {
+	return &tickers{
+		fetchfeed: time.NewTicker(config.fetchfeedInterval),
+		sendemail: time.NewTicker(time.Duration(config.sendemailInterval) * time.Minute),
+		stats:     time.NewTicker(config.statsInterval),
+		outbox:    time.NewTicker(config.outboxInterval),
+	}
+}
+
+func (tick *tickers) stop() {
+	tick.fetchfeed.Stop()
+	tick.sendemail.Stop()
+	tick.stats.Stop()
+	tick.outbox.Stop()
+}
+
+// registerJobs declares the periodic jobs to the health checks.
+func registerJobs(config *emailConfig) {
+	jobs.register("fetchemail", config.fetchemailInterval)
+	jobs.register("fetchfeed", config.fetchfeedInterval)
+	jobs.register("sendemail", time.Duration(config.sendemailInterval)*time.Minute)
+	jobs.register("stats", config.statsInterval)
+	jobs.register("outbox", config.outboxInterval)
+}
+
+// startInbox watches the command inbox in the background, the returned
+// function stops watching and waits until it's done.
+func startInbox(config *emailConfig) func() {
+	inbox := newCommandInbox(config)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inbox.watch(stop)
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// superviseInbox watches the command inbox, restarting it with every config
+// received from configs. Stopping the inbox waits for its session to end, so
+// it's done here rather than in the caller's loop. Closing configs stops
+// watching, the returned channel is closed once done.
+func superviseInbox(config *emailConfig, configs <-chan *emailConfig) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		stop := startInbox(config)
+		for config := range configs {
+			stop()
+			stop = startInbox(config)
+		}
+		stop()
+	}()
+	return done
+}
+
+// restartInbox hands config to superviseInbox without waiting, a restart not
+// started yet is replaced.
+func restartInbox(configs chan *emailConfig, config *emailConfig) {
+	select {
+	case configs <- config:
+	default:
+		select {
+		case <-configs:
+		default:
+		}
+		configs <- config
+	}
+}
+
+// restartHTTP replaces server with one serving config and returns it. When
+// the new address can't be bound the current server keeps running.
+func restartHTTP(server *http.Server, config *emailConfig) *http.Server {
+	// the same address is free only once the current server is gone
+	if server != nil && (config.httpAddr == "" || config.httpAddr == server.Addr) {
+		shutdownHTTP(server)
+		server = nil
+	}
+	if config.httpAddr == "" {
+		return server
+	}
+
+	newServer, err := startHTTP(config)
+	if err != nil {
+		if server != nil {
+			log.Printf("error http server, keeping the one on %s: %v", server.Addr, err)
+			return server
 		}
+		log.Println("error http server", err)
+		return nil
+	}
+	if server != nil {
+		shutdownHTTP(server)
+	}
+	return newServer
+}
+
+// parseConfig reads the settings from args, the environment and the config
+// file, they are not verified as commands need only some. fs is returned for
+// its usage and the command following the flags.
+func parseConfig(args []string, errorHandling flag.ErrorHandling) (*emailConfig, *flag.FlagSet, error) {
+	config := &emailConfig{}
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] [command]\n\nCommands:\n%s\nFlags:\n", fs.Name(), commandUsage)
+		fs.PrintDefaults()
+	}
 
+	fs.String("config", "", "YAML `file` of settings named like the flags, flags and RSS_EMAIL_* environment variables take precedence")
+	for _, name := range secretSettings {
+		fs.String(name+"File", "", "read -"+name+" from `file`")
 	}
+	fs.StringVar(&config.dataDir, "dataDir", "/rss-email", "`directory` keeping subscriptions, the outbox and inbox state")
+	fs.StringVar(&config.templateDir, "templateDir", "", "`directory` of digest templates, e.g. full.html, overriding the built-in ones")
+	fs.BoolVar(&config.dryRun, "dryRun", false, "write every email and webhook request to -dryRunDir instead of sending it, commands are left unread and no state is saved")
+	fs.StringVar(&config.dryRunDir, "dryRunDir", "dry-run", "`directory` of the messages written with -dryRun")
+
+	fs.StringVar(&config.from, "email", "", "`email` address serving rss-email service")
+	fs.StringVar(&config.smtpServer, "smtpServer", "", "smtp mail relay, `server[:port]`")
+	fs.StringVar(&config.imapServer, "imapServer", "", "imap server, `server[:port]`")
+	fs.StringVar(&config.pop3Server, "pop3Server", "", "pop3 server, `server[:port]`")
+	fs.StringVar(&config.inbox, "inbox", inboxIMAP, "`protocol` reading the command inbox: imap or pop3")
+	fs.StringVar(&config.username, "username", "", "authentication `user` (for SMTP/IMAP authentication)")
+	fs.StringVar(&config.password, "password", "", "authentication `password` (for SMTP/IMAP authentication)")
+
+	fs.StringVar(&config.smtpTLS, "smtpTLS", tlsOpportunistic, "smtp transport security: implicit, starttls, opportunistic or plain")
+	fs.StringVar(&config.imapTLS, "imapTLS", tlsImplicit, "imap transport security: implicit, starttls, opportunistic or plain")
+	fs.StringVar(&config.pop3TLS, "pop3TLS", tlsImplicit, "pop3 transport security: implicit, starttls, opportunistic or plain")
+	fs.StringVar(&config.tlsCA, "tlsCA", "", "PEM `file` of CA certificates trusted for SMTP/IMAP, instead of the system pool")
+	fs.StringVar(&config.tlsCert, "tlsCert", "", "PEM client certificate `file` for SMTP/IMAP")
+	fs.StringVar(&config.tlsKey, "tlsKey", "", "PEM client key `file` for SMTP/IMAP")
+	fs.BoolVar(&config.insecureSkipVerify, "insecureSkipVerify", false, "don't verify server certificates, for lab setups only")
+
+	var mailboxes string
+	fs.StringVar(&mailboxes, "mailboxes", "INBOX", "comma separated `mailboxes` scanned for commands, new messages in the first one are handled immediately")
+	fs.BoolVar(&config.scanJunk, "scanJunk", true, "also scan the junk mailbox, detected by its SPECIAL-USE attribute")
+	fs.StringVar(&config.processedMailbox, "processedMailbox", "", "move handled command emails to `mailbox`, leave them in place if empty")
+
+	fs.StringVar(&config.delivery, "delivery", deliverSMTP, "default `delivery` of digests: smtp, maildir, mbox or imap")
+	fs.StringVar(&config.maildir, "maildir", "", "Maildir `directory` digests are written to with -delivery maildir")
+	fs.StringVar(&config.mbox, "mbox", "", "mbox `file` digests are appended to with -delivery mbox")
+
+	fs.StringVar(&config.appendFolder, "appendFolder", "Feeds", "imap `folder` digests are appended to with -delivery imap")
+	fs.BoolVar(&config.appendPerTag, "appendPerTag", false, "with -delivery imap, append tagged feeds to a sub folder of -appendFolder named after the tag")
+
+	fs.StringVar(&config.webhookSecret, "webhookSecret", "", "`secret` signing webhook requests with HMAC-SHA256 in X-RSS-Email-Server-Signature, in addition to the user's own")
+	var allowPrivate string
+	fs.StringVar(&allowPrivate, "allowPrivate", "", "comma separated `hosts`, addresses and networks webhooks, images and enclosures may reach although loopback, private or link-local")
+
+	fs.StringVar(&config.httpAddr, "httpAddr", "", "serve http on `address`, e.g. :8080, disabled if empty")
+	fs.StringVar(&config.publicURL, "publicURL", "", "`url` the http server is reachable at from outside, e.g. https://rss.example.com, links to personal feeds are sent only if set")
+
+	fs.StringVar(&config.adminToken, "adminToken", "", "`token` protecting the admin dashboard on /admin/ and the API on /api/, disabled if empty")
+	fs.IntVar(&config.healthMultiple, "healthMultiple", 3, "/healthz and /readyz fail when a job hasn't completed within `n` times its interval")
+
+	fs.IntVar(&config.smtpPerMinute, "smtpPerMinute", 30, "send at most `n` emails per minute, 0 for no limit")
+	fs.IntVar(&config.smtpPerDay, "smtpPerDay", 0, "send at most `n` emails per day, 0 for no limit")
+
+	fs.IntVar(&config.maxFeedItems, "maxFeedItems", 0, "digests carry at most `n` full items per feed, the others as headlines, 0 for no limit")
+	fs.IntVar(&config.maxItems, "maxItems", 0, "digests carry at most `n` full items, the others as headlines, 0 for no limit")
+	fs.IntVar(&config.truncate, "truncate", 0, "cut item content after `n` characters of text, 0 to keep it whole")
+	fs.IntVar(&config.maxDigestSize, "maxDigestSize", 0, "digests carry about `kilobytes` of item content, the remaining items as headlines, 0 for no limit")
+
+	fs.StringVar(&config.images, "images", imagesRemote, "default `policy` of images in digests: remote leaves them, strip removes them, embed attaches them")
+	fs.IntVar(&config.imageMaxSize, "imageMaxSize", 512, "embed images of at most `kilobytes`, the larger ones are stripped")
+	fs.IntVar(&config.imageMaxTotal, "imageMaxTotal", 4096, "embed at most `kilobytes` of images in a digest, the others are stripped")
+
+	fs.IntVar(&config.attachMaxSize, "attachMaxSize", 1024, "attach enclosures of at most `kilobytes` to digests of feeds opting in with the attach command")
+	fs.IntVar(&config.attachMaxTotal, "attachMaxTotal", 8192, "attach at most `kilobytes` of enclosures to a digest")
+
+	fs.IntVar(&config.sendemailInterval, "sendemailInterval", 10, "specify email sending interval, in `minutes`")
+	fs.DurationVar(&config.fetchemailInterval, "fetchemailInterval", 5*time.Minute, "the `interval` checking every mailbox, new messages in the first one are handled immediately")
+	fs.DurationVar(&config.fetchfeedInterval, "fetchfeedInterval", 30*time.Minute, "the `interval` fetching RSS feeds")
+	fs.DurationVar(&config.statsInterval, "statsInterval", 20*time.Second, "the `interval` logging user and subscription counts")
+	fs.DurationVar(&config.outboxInterval, "outboxInterval", time.Minute, "the `interval` retrying queued emails")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, fs, err
+	}
+	if err := loadConfig(fs); err != nil {
+		return nil, fs, err
+	}
+	config.mailboxes = splitList(mailboxes)
+	config.allowPrivate = splitList(allowPrivate)
+
+	return config, fs, nil
 }
 
+// verifyConfig checks the settings, errors name the flag at fault.
 func verifyConfig(config *emailConfig) error {
 	if config.from == "" {
-		return errors.New("missing flag")
+		return errors.New("email: missing")
 	}
-	if config.imapServer == "" {
-		return errors.New("missing flag")
+	if config.inbox != inboxIMAP && config.inbox != inboxPOP3 {
+		return fmt.Errorf("inbox: %q is not imap or pop3", config.inbox)
 	}
-	if config.smtpServer == "" {
-		return errors.New("missing flag")
+	if config.inbox == inboxIMAP && config.imapServer == "" {
+		return errors.New("imapServer: missing, required with inbox imap")
+	}
+	if config.inbox == inboxPOP3 && config.pop3Server == "" {
+		return errors.New("pop3Server: missing, required with inbox pop3")
+	}
+	if !validDelivery(config.delivery) {
+		return fmt.Errorf("delivery: %q is not smtp, maildir, mbox or imap", config.delivery)
+	}
+	if config.delivery == deliverSMTP && config.smtpServer == "" {
+		return errors.New("smtpServer: missing, required with delivery smtp")
+	}
+	// the inbox may be pop3, digests are still appended over imap
+	if config.delivery == deliverIMAP && config.imapServer == "" {
+		return errors.New("imapServer: missing, required with delivery imap")
 	}
 	if config.username == "" {
-		return errors.New("missing flag")
+		return errors.New("username: missing")
 	}
 	if config.password == "" {
-		return errors.New("missing flag")
+		return errors.New("password: missing")
+	}
+	if config.delivery == deliverMaildir && config.maildir == "" {
+		return errors.New("maildir: missing, required with delivery maildir")
+	}
+	if config.delivery == deliverMbox && config.mbox == "" {
+		return errors.New("mbox: missing, required with delivery mbox")
+	}
+	if config.healthMultiple < 1 {
+		return errors.New("healthMultiple: must be at least 1")
+	}
+	if len(config.mailboxes) == 0 {
+		return errors.New("mailboxes: missing")
+	}
+	for _, tls := range []struct{ name, mode string }{
+		{"smtpTLS", config.smtpTLS}, {"imapTLS", config.imapTLS}, {"pop3TLS", config.pop3TLS},
+	} {
+		if !validTLSMode(tls.mode) {
+			return fmt.Errorf("%s: %q is not implicit, starttls, opportunistic or plain", tls.name, tls.mode)
+		}
+	}
+	if (config.tlsCert == "") != (config.tlsKey == "") {
+		return errors.New("tlsCert, tlsKey: go together")
+	}
+	if config.sendemailInterval < 1 {
+		return errors.New("sendemailInterval: must be at least 1")
+	}
+	for _, interval := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"fetchemailInterval", config.fetchemailInterval},
+		{"fetchfeedInterval", config.fetchfeedInterval},
+		{"statsInterval", config.statsInterval},
+		{"outboxInterval", config.outboxInterval},
+	} {
+		if interval.value <= 0 {
+			return fmt.Errorf("%s: must be positive", interval.name)
+		}
+	}
+	if !validImages(config.images) {
+		return fmt.Errorf("images: %q is not remote, strip or embed", config.images)
+	}
+	if config.dataDir == "" {
+		return errors.New("dataDir: missing")
+	}
+	if config.dryRun && config.dryRunDir == "" {
+		return errors.New("dryRunDir: missing, required with dryRun")
 	}
 	return nil
 }
+
+// splitList splits a comma separated flag value, dropping empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
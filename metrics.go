@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	feedFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rss_email_feed_fetches_total",
+		Help: "Feed fetches by HTTP status class, or error when no response was received.",
+	}, []string{"status"})
+
+	feedFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "rss_email_feed_fetch_duration_seconds",
+		Help:    "Time to download one feed.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+
+	feedParseErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rss_email_feed_parse_errors_total",
+		Help: "Downloaded feeds which couldn't be parsed.",
+	})
+
+	emailsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rss_email_emails_sent_total",
+		Help: "Messages delivered from the outbox, by delivery.",
+	}, []string{"delivery"})
+
+	emailsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rss_email_emails_failed_total",
+		Help: "Failed delivery attempts by delivery, reason is temporary when the message is retried.",
+	}, []string{"delivery", "reason"})
+
+	commandsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rss_email_commands_total",
+		Help: "Command emails processed, by command.",
+	}, []string{"command"})
+
+	jobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rss_email_job_last_success_timestamp_seconds",
+		Help: "Unix time the job last completed successfully.",
+	}, []string{"job"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "rss_email_outbox_depth",
+		Help: "Messages waiting in the outbox.",
+	}, func() float64 { return float64(outbox.depth()) })
+)
+
+// the commands counted under their own name, others count as unknown
+var knownCommands = map[string]bool{
+	"subscribe":   true,
+	"add":         true,
+	"remove":      true,
+	"list":        true,
+	"unsubscribe": true,
+	"tag":         true,
+	"webhook":     true,
+	"template":    true,
+	"format":      true,
+	"limit":       true,
+	"images":      true,
+	"attach":      true,
+	"sort":        true,
+}
+
+func commandLabel(command string) string {
+	name := strings.SplitN(command, " ", 2)[0]
+	if knownCommands[name] {
+		return name
+	}
+	return "unknown"
+}
+
+// statusClass returns the label of an HTTP status code, e.g. 2xx.
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_commandLabel(t *testing.T) {
+	tests := map[string]string{
+		"subscribe":                  "subscribe",
+		"add https://a.example.com/": "add",
+		"tag https://a/feed news":    "tag",
+		"sort oldest":                "sort",
+		"":                           "unknown",
+		"Subscribe":                  "unknown",
+		" list":                      "unknown",
+		"rm https://a/feed":          "unknown",
+	}
+	for command, want := range tests {
+		if got := commandLabel(command); got != want {
+			t.Errorf("commandLabel(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func Test_statusClass(t *testing.T) {
+	tests := map[int]string{
+		200: "2xx",
+		204: "2xx",
+		301: "3xx",
+		404: "4xx",
+		429: "4xx",
+		503: "5xx",
+	}
+	for code, want := range tests {
+		if got := statusClass(code); got != want {
+			t.Errorf("statusClass(%d) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func Test_httpGetCountsFetches(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("<rss></rss>"))
+	}))
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	defer server.Close()
+
+	tests := []struct {
+		url    string
+		status string
+	}{
+		{server.URL + "/feed", "2xx"},
+		{server.URL + "/missing", "4xx"},
+		{closed.URL + "/feed", "error"},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(feedFetches.WithLabelValues(tt.status))
+		httpGet(tt.url)
+		if got := testutil.ToFloat64(feedFetches.WithLabelValues(tt.status)) - before; got != 1 {
+			t.Errorf("fetching %s counted %v under %s, want 1", tt.url, got, tt.status)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errPrivateAddress refuses requests to the deployment's own networks, anyone
+// able to email the service picks webhook urls, and feeds pick image and
+// enclosure urls.
+var errPrivateAddress = errors.New("loopback, private and link-local addresses are not allowed, see -allowPrivate")
+
+// networks requests of users and feeds must not reach
+var privateNets = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// guardedClient returns an http client for urls picked by users or feeds. It
+// checks the address a connection is made to, after name resolution and on
+// every redirect, so no host name can point it at privateNets. Hosts,
+// addresses and networks in config.allowPrivate are let through.
+func guardedClient(config *emailConfig, timeout time.Duration) *http.Client {
+	allowed := config.allowPrivate
+	guarded := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || (privateIP(ip) && !allowedPrivate(allowed, host)) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	plain := &net.Dialer{Timeout: timeout}
+
+	transport := &http.Transport{
+		// no proxy from the environment, it would dial in our place
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err == nil && allowedPrivate(allowed, host) {
+				return plain.DialContext(ctx, network, addr)
+			}
+			return guarded.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func privateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedPrivate reports whether host, a name or an address, is listed in
+// allowed by name, address or network.
+func allowedPrivate(allowed []string, host string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range allowed {
+		if strings.EqualFold(entry, host) {
+			return true
+		}
+		if _, n, err := net.ParseCIDR(entry); err == nil && ip != nil && n.Contains(ip) {
+			return true
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
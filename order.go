@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// digest orders users can pick with the sort command
+const (
+	sortTag    = "tag"
+	sortTitle  = "title"
+	sortNewest = "newest"
+)
+
+// the digest order used unless a user picks another
+const defaultSort = sortTag
+
+func validSort(order string) bool {
+	return order == sortTag || order == sortTitle || order == sortNewest
+}
+
+// digestGroup is a section of a digest, the feeds of one tag. Digests not
+// sorted by tag have a single group without tag.
+type digestGroup struct {
+	Tag   string
+	Count int
+	Feeds []*digestFeed
+}
+
+// sortDigest orders the feeds of param, by tag then title, by title or by
+// their newest item, and groups them by tag for sortTag. Feeds are numbered
+// for the anchors of the table of contents and counted before any limit.
+func sortDigest(param *bodyParam, order string) {
+	if !validSort(order) {
+		order = defaultSort
+	}
+
+	newest := make(map[*digestFeed]time.Time)
+	for _, feed := range param.Feeds {
+		feed.Count = len(feed.Items)
+		for _, item := range feed.Items {
+			if date := itemDate(item); date.After(newest[feed]) {
+				newest[feed] = date
+			}
+		}
+	}
+
+	feeds := param.Feeds
+	sort.SliceStable(feeds, func(i, j int) bool {
+		a, b := feeds[i], feeds[j]
+		if order == sortTag && a.Tag != b.Tag {
+			// untagged feeds go last
+			return b.Tag == "" || (a.Tag != "" && a.Tag < b.Tag)
+		}
+		if order == sortNewest && !newest[a].Equal(newest[b]) {
+			return newest[a].After(newest[b])
+		}
+		if titleA, titleB := strings.ToLower(a.Title), strings.ToLower(b.Title); titleA != titleB {
+			return titleA < titleB
+		}
+		return a.url < b.url
+	})
+
+	param.Groups = nil
+	for i, feed := range feeds {
+		feed.Anchor = "feed-" + strconv.Itoa(i+1)
+
+		tag := ""
+		if order == sortTag {
+			tag = feed.Tag
+		}
+		if len(param.Groups) == 0 || param.Groups[len(param.Groups)-1].Tag != tag {
+			param.Groups = append(param.Groups, &digestGroup{Tag: tag})
+		}
+		group := param.Groups[len(param.Groups)-1]
+		group.Feeds = append(group.Feeds, feed)
+		group.Count += feed.Count
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func Test_sortDigest(t *testing.T) {
+	newFeed := func(title, tag string, day int, n int) *digestFeed {
+		published := time.Date(2020, 4, day, 10, 0, 0, 0, time.UTC)
+		feed := &gofeed.Feed{Title: title, Link: "https://" + title}
+		for i := 0; i < n; i++ {
+			feed.Items = append(feed.Items, &gofeed.Item{Title: title + " post", PublishedParsed: &published})
+		}
+		return &digestFeed{Feed: feed, Tag: tag, url: "https://" + title + "/feed"}
+	}
+	newParam := func() *bodyParam {
+		return &bodyParam{Feeds: []*digestFeed{
+			newFeed("delta", "", 4, 1),
+			newFeed("Charlie", "news", 1, 2),
+			newFeed("bravo", "tech", 3, 1),
+			newFeed("alpha", "news", 2, 3),
+		}}
+	}
+	titles := func(feeds []*digestFeed) string {
+		var res []string
+		for _, feed := range feeds {
+			res = append(res, feed.Title)
+		}
+		return strings.Join(res, ",")
+	}
+
+	tests := []struct {
+		order  string
+		want   string
+		groups []string
+	}{
+		{sortTag, "alpha,Charlie,bravo,delta", []string{"news", "tech", ""}},
+		{sortTitle, "alpha,bravo,Charlie,delta", []string{""}},
+		{sortNewest, "delta,bravo,alpha,Charlie", []string{""}},
+		// unknown orders fall back to the default
+		{"", "alpha,Charlie,bravo,delta", []string{"news", "tech", ""}},
+	}
+	for _, tt := range tests {
+		param := newParam()
+		sortDigest(param, tt.order)
+		if got := titles(param.Feeds); got != tt.want {
+			t.Errorf("%s: feeds %s, want %s", tt.order, got, tt.want)
+		}
+		var groups []string
+		for _, group := range param.Groups {
+			groups = append(groups, group.Tag)
+		}
+		if strings.Join(groups, ",") != strings.Join(tt.groups, ",") {
+			t.Errorf("%s: groups %q, want %q", tt.order, groups, tt.groups)
+		}
+	}
+
+	param := newParam()
+	sortDigest(param, sortTag)
+	if news := param.Groups[0]; news.Count != 5 || news.Feeds[1].Anchor != "feed-2" || news.Feeds[1].Count != 2 {
+		t.Errorf("news group counts %d, second feed %s with %d", news.Count, news.Feeds[1].Anchor, news.Feeds[1].Count)
+	}
+
+	templateCache.reset()
+	got, err := parsefeed(&emailConfig{}, "full", param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<li><b>news</b> (5)<ul>`, `<a href="#feed-2">Charlie</a> (2)`, `id="feed-2"`, `<h1>tech (1)</h1>`, `<h1>Other (1)</h1>`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("digest lacks %q", want)
+		}
+	}
+
+	got, err = parsefeedText(&emailConfig{}, param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Contents:\nnews (5)\n  - alpha (3)\n  - Charlie (2)\ntech (1)\n  - bravo (1)\nOther (1)\n  - delta (1)\n\n\n# news (5)\n\nalpha (3) [1]\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("text digest lacks %q:\n%s", want, got)
+		}
+	}
+}
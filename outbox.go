@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/textproto"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+var outboxFilePath = path.Join("/", "rss-email", "outbox")
+
+// give up on a message after this many failed attempts
+const outboxMaxAttempts = 10
+
+// delay before the first retry, doubled on every following attempt
+const outboxBaseBackoff = time.Minute
+
+// upper bound of the delay between two attempts
+const outboxMaxBackoff = 6 * time.Hour
+
+// outboxMessage is one composed email waiting to be delivered.
+type outboxMessage struct {
+	ID string
+	To string
+	// Via names the deliverer, empty for messages queued before there was a choice
+	Via string `json:",omitempty"`
+	// Path is where deliverers other than smtp write to: a directory, a
+	// file or an imap folder
+	Path string `json:",omitempty"`
+	Data []byte
+	// Commits maps feed url to the LastHash, or WebhookHash for webhooks,
+	// which is committed to the recipient's subscription once the message is
+	// accepted.
+	Commits     map[string]string `json:",omitempty"`
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+}
+
+type outboxType struct {
+	sync.Mutex
+	Pending []*outboxMessage
+	Failed  []*outboxMessage
+	Quota   smtpQuota
+}
+
+func newOutbox() outboxType {
+	return outboxType{}
+}
+
+func newOutboxID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// enqueue stores msg to be delivered by the next drain.
+func (outbox *outboxType) enqueue(msg *outboxMessage) error {
+	now := time.Now()
+	msg.ID = newOutboxID()
+	msg.Created = now
+	msg.NextAttempt = now
+
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	outbox.Pending = append(outbox.Pending, msg)
+
+	return outbox.saveToDisk()
+}
+
+// pendingDigest reports whether a digest carrying feed state is still queued
+// for to, a new digest composed meanwhile would repeat its items.
+func (outbox *outboxType) pendingDigest(to string) bool {
+	return outbox.pendingCommits(to, false)
+}
+
+// pendingWebhook is pendingDigest for the webhooks of to.
+func (outbox *outboxType) pendingWebhook(to string) bool {
+	return outbox.pendingCommits(to, true)
+}
+
+// pendingCount returns the number of messages to to still queued.
+func (outbox *outboxType) pendingCount(to string) int {
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	var n int
+	for _, msg := range outbox.Pending {
+		if msg.To == to {
+			n++
+		}
+	}
+	return n
+}
+
+func (outbox *outboxType) pendingCommits(to string, webhook bool) bool {
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	for _, msg := range outbox.Pending {
+		if msg.To == to && len(msg.Commits) != 0 && (msg.Via == deliverWebhook) == webhook {
+			return true
+		}
+	}
+	return false
+}
+
+// depth returns the number of queued messages.
+func (outbox *outboxType) depth() int {
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	return len(outbox.Pending)
+}
+
+// drain delivers every message which is due, retrying failed ones with backoff.
+func (outbox *outboxType) drain(config *emailConfig) error {
+	// messages restored from disk wait for a real run
+	if config.dryRun {
+		return nil
+	}
+	now := time.Now()
+
+	outbox.Lock()
+	var due []*outboxMessage
+	for _, msg := range outbox.Pending {
+		if !msg.NextAttempt.After(now) {
+			due = append(due, msg)
+		}
+	}
+	outbox.Unlock()
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	// one connection of each kind for the whole cycle
+	deliverers := newDeliverers(config)
+	defer func() {
+		for _, d := range deliverers {
+			d.close()
+		}
+	}()
+
+	var accepted, failed []*outboxMessage
+	for _, msg := range due {
+		via := msg.Via
+		if via == "" {
+			via = deliverSMTP
+		}
+
+		var err error
+		d, ok := deliverers[via]
+		if !ok {
+			err = permanentError{fmt.Errorf("unknown delivery %q", via)}
+		} else if via == deliverSMTP {
+			outbox.Lock()
+			delay, quotaErr := outbox.Quota.delay(config)
+			outbox.Unlock()
+			if quotaErr == errDailyQuota {
+				log.Printf("%v, email to %s left in outbox", quotaErr, msg.To)
+				continue
+			}
+			time.Sleep(delay)
+
+			err = d.deliver(msg)
+			if err != nil {
+				jobs.setError(deliverSMTP, err)
+			} else {
+				// only accepted messages count against the relay's limits
+				outbox.Lock()
+				outbox.Quota.record()
+				outbox.Unlock()
+			}
+		} else {
+			err = d.deliver(msg)
+		}
+
+		outbox.Lock()
+		if err == nil {
+			emailsSent.WithLabelValues(via).Inc()
+			outbox.remove(msg)
+			accepted = append(accepted, msg)
+		} else {
+			msg.Attempts++
+			msg.LastError = err.Error()
+			if isPermanentError(err) || msg.Attempts >= outboxMaxAttempts {
+				emailsFailed.WithLabelValues(via, "permanent").Inc()
+				log.Printf("giving up email to %s after %d attempts: %v", msg.To, msg.Attempts, err)
+				outbox.remove(msg)
+				outbox.Failed = append(outbox.Failed, msg)
+				failed = append(failed, msg)
+			} else {
+				emailsFailed.WithLabelValues(via, "temporary").Inc()
+				msg.NextAttempt = time.Now().Add(outboxBackoff(msg.Attempts))
+				log.Printf("error sending email to %s, retry at %s: %v", msg.To, msg.NextAttempt.Format(time.RFC3339), err)
+			}
+		}
+		outbox.Unlock()
+	}
+
+	outbox.Lock()
+	err := outbox.saveToDisk()
+	outbox.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := suspendFailed(config, failed); err != nil {
+		return err
+	}
+	return commitAccepted(config, accepted)
+}
+
+// remove deletes msg from the pending list, caller must hold the lock.
+func (outbox *outboxType) remove(msg *outboxMessage) {
+	for i, m := range outbox.Pending {
+		if m == msg {
+			outbox.Pending = append(outbox.Pending[:i], outbox.Pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// suspendFailed stops sending to the recipients of the digests and webhooks
+// given up on. Their feed state stays, so every following cycle would compose
+// the same message failing again.
+func suspendFailed(config *emailConfig, failed []*outboxMessage) error {
+	var suspended bool
+	userSubscriptions.Lock()
+	defer userSubscriptions.Unlock()
+
+	for _, msg := range failed {
+		if _, ok := userSubscriptions.m[msg.To]; !ok || len(msg.Commits) == 0 {
+			continue
+		}
+		log.Printf("sending to %s suspended until a command arrives: %s", msg.To, msg.LastError)
+		userSubscriptions.setPref(msg.To).Suspended = msg.LastError
+		suspended = true
+	}
+
+	if !suspended {
+		return nil
+	}
+	return saveSubscriptions(config)
+}
+
+// commitAccepted advances the feed state of the recipients of accepted messages.
+func commitAccepted(config *emailConfig, accepted []*outboxMessage) error {
+	var committed bool
+	userSubscriptions.Lock()
+	defer userSubscriptions.Unlock()
+
+	for _, msg := range accepted {
+		userUrls, ok := userSubscriptions.m[msg.To]
+		if !ok {
+			continue
+		}
+		for url, hash := range msg.Commits {
+			info, ok := (*userUrls)[url]
+			if !ok {
+				continue
+			}
+			if msg.Via == deliverWebhook {
+				info.WebhookHash = hash
+			} else {
+				info.LastHash = hash
+			}
+			committed = true
+		}
+	}
+
+	if !committed {
+		return nil
+	}
+	return saveSubscriptions(config)
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// isPermanentSMTPError reports whether the relay rejected the message with a
+// 5xx reply, retrying won't help.
+func isPermanentSMTPError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 500 && protoErr.Code < 600
+	}
+	return false
+}
+
+// save outbox to disc.
+func (outbox *outboxType) saveToDisk() error {
+	dir, _ := path.Split(outboxFilePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(outbox)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, a crash never leaves a truncated queue
+	tmp := outboxFilePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, outboxFilePath)
+}
+
+// restore outbox from disc.
+func (outbox *outboxType) restoreFromDisk() error {
+	b, err := ioutil.ReadFile(outboxFilePath)
+	if os.IsNotExist(err) {
+		log.Println("no outbox to restore from")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	return json.Unmarshal(b, outbox)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func Test_outboxBackoff(t *testing.T) {
+	cases := []struct {
+		in   int
+		want time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{20, outboxMaxBackoff},
+	}
+	for _, c := range cases {
+		if got := outboxBackoff(c.in); got != c.want {
+			t.Errorf("outboxBackoff(%d) == %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func Test_isPermanentSMTPError(t *testing.T) {
+	cases := []struct {
+		in   error
+		want bool
+	}{
+		{&textproto.Error{Code: 550, Msg: "mailbox unavailable"}, true},
+		{fmt.Errorf("wrapped: %w", &textproto.Error{Code: 554, Msg: "rejected"}), true},
+		{&textproto.Error{Code: 451, Msg: "try again later"}, false},
+		{errors.New("connection reset by peer"), false},
+	}
+	for _, c := range cases {
+		if got := isPermanentSMTPError(c.in); got != c.want {
+			t.Errorf("isPermanentSMTPError(%q) == %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func Test_drainSuspendsFailedRecipients(t *testing.T) {
+	keepState(t)
+	config := &emailConfig{from: "rss@example.com"}
+
+	published := time.Date(2020, 4, 23, 10, 0, 0, 0, time.UTC)
+	subscription.m["https://a.example.com/feed"] = &urlInfo{lastUpdate: time.Now(), feed: &gofeed.Feed{Title: "A", Items: []*gofeed.Item{
+		{Title: "a1", Link: "https://a.example.com/1", PublishedParsed: &published},
+	}}}
+	subscribeUser("a@example.com", []string{"https://a.example.com/feed"})
+	// a delivery failing for good
+	userSubscriptions.setPref("a@example.com").Delivery = "pigeon"
+
+	if err := sendSubscription(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.drain(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox.Failed) != 1 || userSubscriptions.pref("a@example.com").Suspended == "" {
+		t.Fatalf("%d failed messages, suspended %q", len(outbox.Failed), userSubscriptions.pref("a@example.com").Suspended)
+	}
+
+	// the same items are not queued again and again
+	if err := sendSubscription(config); err != nil {
+		t.Fatal(err)
+	}
+	if outbox.depth() != 0 {
+		t.Errorf("suspended recipient got %d new messages", outbox.depth())
+	}
+
+	// a command resumes sending
+	userSubscriptions.setPref("a@example.com").Delivery = ""
+	msg, err := mail.ReadMessage(strings.NewReader("From: a@example.com\r\nSubject: rss-email list\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := processMessage(config, msg); err != nil {
+		t.Fatal(err)
+	}
+	if suspended := userSubscriptions.pref("a@example.com").Suspended; suspended != "" {
+		t.Errorf("still suspended after a command: %q", suspended)
+	}
+	if err := sendSubscription(config); err != nil {
+		t.Fatal(err)
+	}
+	if outbox.pendingCount("a@example.com") != 2 {
+		t.Errorf("%d messages queued after resuming, want the reply and the digest", outbox.pendingCount("a@example.com"))
+	}
+}
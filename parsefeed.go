@@ -2,26 +2,128 @@ package main
 
 import (
 	"bytes"
+	"embed"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
 	"text/template"
-
-	"github.com/mmcdole/gofeed"
 )
 
+// the digest template used unless a user picks another
+const defaultTemplate = "full"
+
+// the digest templates users can pick with the template command
+var knownTemplates = []string{"full", "compact", "headlines"}
+
+// the single template of older versions. In -templateDir it still overrides
+// full.html, the working directory is not read anymore.
+const legacyTemplate = "email-template.html"
+
+// logs that a legacy template in the working directory is ignored
+var legacyHint sync.Once
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
 type bodyParam struct {
-	Feeds   []*gofeed.Feed
+	// Feeds in order, Groups has them by tag, see sortDigest
+	Feeds   []*digestFeed
+	Groups  []*digestGroup
 	Expect  int
 	Actual  int
 	ShowErr bool
 }
 
-func parsefeed(param *bodyParam) (string, error) {
-	tmpl, err := template.ParseFiles("email-template.html")
+func validTemplate(name string) bool {
+	for _, known := range knownTemplates {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// templateCacheType keeps parsed digest templates until the configuration is
+// reloaded.
+type templateCacheType struct {
+	sync.Mutex
+	m map[string]*template.Template
+}
+
+var templateCache = templateCacheType{m: make(map[string]*template.Template)}
+
+// get returns the parsed template file, the one in config.templateDir
+// overrides the embedded one.
+func (cache *templateCacheType) get(config *emailConfig, file string) (*template.Template, error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if tmpl, ok := cache.m[file]; ok {
+		return tmpl, nil
+	}
+
+	var src []byte
+	err := os.ErrNotExist
+	if config.templateDir != "" {
+		src, err = ioutil.ReadFile(filepath.Join(config.templateDir, file))
+	}
+	if os.IsNotExist(err) && file == defaultTemplate+".html" {
+		if config.templateDir != "" {
+			legacy := filepath.Join(config.templateDir, legacyTemplate)
+			if src, err = ioutil.ReadFile(legacy); err == nil {
+				log.Printf("%s is deprecated, rename it to %s", legacy, file)
+			}
+		} else if _, statErr := os.Stat(legacyTemplate); statErr == nil {
+			legacyHint.Do(func() {
+				log.Printf("%s in the working directory is ignored, move it to -templateDir as %s", legacyTemplate, file)
+			})
+		}
+	}
+	if os.IsNotExist(err) {
+		src, err = embeddedTemplates.ReadFile("templates/" + file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(file).Funcs(templateFuncs).Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+	cache.m[file] = tmpl
+	return tmpl, nil
+}
+
+// reset forgets the parsed templates, they are read again on next use.
+func (cache *templateCacheType) reset() {
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.m = make(map[string]*template.Template)
+}
+
+func parsefeed(config *emailConfig, name string, param *bodyParam) (string, error) {
+	if !validTemplate(name) {
+		name = defaultTemplate
+	}
+	return renderTemplate(config, name+".html", param)
+}
+
+// parsefeedText renders param as plain text.
+func parsefeedText(config *emailConfig, param *bodyParam) (string, error) {
+	return renderTemplate(config, textTemplate+".txt", newTextParam(param))
+}
+
+func renderTemplate(config *emailConfig, file string, data interface{}) (string, error) {
+	tmpl, err := templateCache.get(config, file)
 	if err != nil {
 		return "", err
 	}
 
 	out := &bytes.Buffer{}
-	err = tmpl.Execute(out, param)
+	err = tmpl.Execute(out, data)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func Test_parsefeed(t *testing.T) {
+	published := time.Date(2020, 4, 23, 10, 0, 0, 0, time.UTC)
+	param := &bodyParam{Expect: 1, Actual: 1, Feeds: []*digestFeed{{Feed: &gofeed.Feed{
+		Title: "Blog",
+		Link:  "https://blog.example.com",
+		Items: []*gofeed.Item{{
+			Title:           "Post",
+			Link:            "https://blog.example.com/post",
+			Description:     "the summary",
+			Content:         "the whole post",
+			PublishedParsed: &published,
+		}},
+	}}}}
+	sortDigest(param, defaultSort)
+
+	tests := []struct {
+		template string
+		want     []string
+		notWant  []string
+	}{
+		// Description is mostly a summary of Content
+		{"full", []string{"Post", "the whole post"}, []string{"the summary"}},
+		{"compact", []string{"Post", "the summary"}, []string{"the whole post"}},
+		{"headlines", []string{"Post"}, []string{"the summary", "the whole post"}},
+		// unknown templates fall back to the default
+		{"", []string{"the whole post"}, nil},
+	}
+	templateCache.reset()
+	for _, tt := range tests {
+		got, err := parsefeed(&emailConfig{}, tt.template, param)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.template, err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s template lacks %q", tt.template, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(got, notWant) {
+				t.Errorf("%s template has %q", tt.template, notWant)
+			}
+		}
+	}
+}
+
+func Test_parsefeedUndated(t *testing.T) {
+	param := &bodyParam{Expect: 1, Actual: 1, Feeds: []*digestFeed{{Feed: &gofeed.Feed{
+		Title: "Blog",
+		Items: []*gofeed.Item{{Title: "Undated post", Link: "https://blog.example.com/post"}},
+	}}}}
+	sortDigest(param, defaultSort)
+
+	templateCache.reset()
+	for _, name := range knownTemplates {
+		got, err := parsefeed(&emailConfig{}, name, param)
+		if err != nil || !strings.Contains(got, "Undated post") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func Test_templateDirOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rss-email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "headlines.html"), []byte("custom {{len .Feeds}}"), 0600)
+
+	config := &emailConfig{templateDir: dir}
+	templateCache.reset()
+	defer templateCache.reset()
+
+	got, err := parsefeed(config, "headlines", &bodyParam{})
+	if err != nil || got != "custom 0" {
+		t.Errorf("override rendered %q, %v", got, err)
+	}
+	// not overridden, built in
+	if _, err := parsefeed(config, "compact", &bodyParam{}); err != nil {
+		t.Error(err)
+	}
+
+	// the template of older versions still overrides full, until full.html exists
+	ioutil.WriteFile(filepath.Join(dir, legacyTemplate), []byte("legacy"), 0600)
+	if got, err := parsefeed(config, "full", &bodyParam{}); err != nil || got != "legacy" {
+		t.Errorf("legacy template rendered %q, %v", got, err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "full.html"), []byte("full"), 0600)
+	templateCache.reset()
+	if got, err := parsefeed(config, "full", &bodyParam{}); err != nil || got != "full" {
+		t.Errorf("full.html rendered %q, %v", got, err)
+	}
+
+	// the working directory is not read without -templateDir
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	templateCache.reset()
+	if got, err := parsefeed(&emailConfig{}, "full", &bodyParam{}); err != nil || got == "legacy" {
+		t.Errorf("legacy template in the working directory rendered %q, %v", got, err)
+	}
+}
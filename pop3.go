@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var pop3SeenFilePath = path.Join("/", "rss-email", "pop3")
+
+// pop3SeenType holds the UIDL of every message already handled, it's only
+// accessed while holding userSubscriptions lock.
+type pop3SeenType struct {
+	// the mailbox has been looked at before, see watchPOP3
+	Initialized bool
+	UIDs        map[string]bool
+}
+
+func newPOP3Seen() *pop3SeenType {
+	return &pop3SeenType{UIDs: make(map[string]bool)}
+}
+
+// save seen UIDLs to disc.
+func (seen *pop3SeenType) saveToDisk() error {
+	dir, _ := path.Split(pop3SeenFilePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(pop3SeenFilePath, b, 0600)
+}
+
+// restore seen UIDLs from disc.
+func (seen *pop3SeenType) restoreFromDisk() error {
+	b, err := ioutil.ReadFile(pop3SeenFilePath)
+	if os.IsNotExist(err) {
+		log.Println("no pop3 state to restore from")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, seen)
+}
+
+// watchPOP3 polls the pop3 mailbox every config.fetchemailInterval until stop is
+// closed. POP3 has no flags, messages are told apart by their UIDL. On the very
+// first run existing messages are only recorded, old commands are not replayed.
+func watchPOP3(config *emailConfig, stop <-chan struct{}) {
+	for {
+		log.Println("fetchemail ...")
+		jobs.start("fetchemail")
+		err := fetchPOP3(config)
+		if err != nil {
+			log.Printf("error fetchPOP3: %v", err)
+			jobs.setError(config.inbox, err)
+		}
+		jobs.finish("fetchemail", err)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(config.fetchemailInterval):
+		}
+	}
+}
+
+func fetchPOP3(config *emailConfig) error {
+	c, err := dialPOP3(config)
+	if err != nil {
+		return err
+	}
+	defer c.quit()
+
+	if err := c.login(config.username, config.password); err != nil {
+		return err
+	}
+
+	messages, err := c.uidl()
+	if err != nil {
+		return err
+	}
+
+	userSubscriptions.Lock()
+	defer userSubscriptions.Unlock()
+
+	onServer := make(map[string]bool)
+	for _, msg := range messages {
+		onServer[msg.uid] = true
+		if pop3Seen.UIDs[msg.uid] {
+			continue
+		}
+		if !pop3Seen.Initialized {
+			pop3Seen.UIDs[msg.uid] = true
+			continue
+		}
+
+		raw, err := c.retr(msg.num)
+		if err != nil {
+			return err
+		}
+
+		if _, err := processRaw(config, bytes.NewReader(raw)); err != nil {
+			// retry next time
+			log.Printf("error processing pop3 message %s: %v", msg.uid, err)
+			continue
+		}
+		pop3Seen.UIDs[msg.uid] = true
+	}
+
+	if !pop3Seen.Initialized {
+		log.Printf("%d existing pop3 messages recorded as seen", len(messages))
+		pop3Seen.Initialized = true
+	}
+
+	// forget messages deleted from the server
+	for uid := range pop3Seen.UIDs {
+		if !onServer[uid] {
+			delete(pop3Seen.UIDs, uid)
+		}
+	}
+
+	// handled in this run only, a real run handles them again
+	if config.dryRun {
+		return nil
+	}
+	if err := pop3Seen.saveToDisk(); err != nil {
+		return err
+	}
+
+	if err := userSubscriptions.saveToDisk(); err != nil {
+		log.Panicln("error save to disk")
+	}
+	log.Println("user info saved to disk")
+
+	return nil
+}
+
+// pop3Client implements the few POP3 (RFC 1939) commands rss-email needs.
+type pop3Client struct {
+	conn *textproto.Conn
+}
+
+type pop3Message struct {
+	num int
+	uid string
+}
+
+func dialPOP3(config *emailConfig) (*pop3Client, error) {
+	host, _, err := net.SplitHostPort(config.pop3Server)
+	if err != nil {
+		host = config.pop3Server
+	}
+
+	tlsConf, err := config.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if config.pop3TLS == tlsImplicit {
+		conn, err = tls.Dial("tcp", config.pop3Server, tlsConf)
+	} else {
+		conn, err = net.Dial("tcp", config.pop3Server)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &pop3Client{conn: textproto.NewConn(conn)}
+	if _, err := c.response(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	if config.pop3TLS == tlsStartTLS || config.pop3TLS == tlsOpportunistic {
+		if _, err := c.cmd("STLS"); err != nil {
+			c.conn.Close()
+			if config.pop3TLS == tlsStartTLS {
+				return nil, fmt.Errorf("pop3 server doesn't support STLS: %v", err)
+			}
+			return nil, errCleartextLogin
+		}
+
+		tlsConn := tls.Client(conn, tlsConf)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn = textproto.NewConn(tlsConn)
+	}
+
+	return c, nil
+}
+
+// response reads a status line, returning its text after +OK.
+func (c *pop3Client) response() (string, error) {
+	line, err := c.conn.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	}
+	return "", errors.New("pop3: " + line)
+}
+
+func (c *pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.conn.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+func (c *pop3Client) login(username, password string) error {
+	if _, err := c.cmd("USER %s", username); err != nil {
+		return err
+	}
+	if _, err := c.cmd("PASS %s", password); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *pop3Client) uidl() ([]pop3Message, error) {
+	if _, err := c.cmd("UIDL"); err != nil {
+		return nil, err
+	}
+
+	lines, err := c.conn.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []pop3Message
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("pop3: malformed UIDL line " + line)
+		}
+		num, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, pop3Message{num, fields[1]})
+	}
+
+	return messages, nil
+}
+
+// retr returns message num with its CRLF line endings, like imap does,
+// extractURLs relies on them.
+func (c *pop3Client) retr(num int) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", num); err != nil {
+		return nil, err
+	}
+	lines, err := c.conn.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	for _, line := range lines {
+		b.WriteString(line + "\r\n")
+	}
+	return b.Bytes(), nil
+}
+
+func (c *pop3Client) quit() {
+	c.cmd("QUIT")
+	c.conn.Close()
+}
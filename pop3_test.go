@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_pop3Client(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	go func() {
+		r := bufio.NewReader(serverConn)
+		replies := map[string]string{
+			"UIDL\r\n":   "+OK\r\n1 a1\r\n2 b2\r\n.\r\n",
+			"RETR 2\r\n": "+OK 30 octets\r\nSubject: rss-email list\r\n\r\n..dotted\r\n.\r\n",
+		}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			reply, ok := replies[line]
+			if !ok {
+				reply = "-ERR unknown command\r\n"
+			}
+			serverConn.Write([]byte(reply))
+		}
+	}()
+
+	c := &pop3Client{conn: textproto.NewConn(clientConn)}
+
+	messages, err := c.uidl()
+	if err != nil {
+		t.Fatalf("uidl error %q", err)
+	}
+	want := []pop3Message{{1, "a1"}, {2, "b2"}}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("uidl() == %v, want %v", messages, want)
+	}
+
+	raw, err := c.retr(2)
+	if err != nil {
+		t.Fatalf("retr error %q", err)
+	}
+	if got, want := string(raw), "Subject: rss-email list\r\n\r\n.dotted\r\n"; got != want {
+		t.Errorf("retr(2) == %q, want %q", got, want)
+	}
+
+	if _, err := c.cmd("NOOP"); err == nil {
+		t.Errorf("cmd(NOOP) succeeded on -ERR reply")
+	}
+}
+
+func Test_fetchPOP3Subscribe(t *testing.T) {
+	dir := keepState(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	message := strings.Join([]string{
+		"From: a@example.com",
+		"Subject: rss-email subscribe",
+		`Content-Type: multipart/alternative; boundary="b"`,
+		"",
+		"--b",
+		"Content-Type: text/plain",
+		"",
+		"https://example.com/feed.xml",
+		"https://example.com/rss",
+		"",
+		"--b--",
+		"",
+	}, "\r\n")
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("+OK ready\r\n"))
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case line == "UIDL\r\n":
+				conn.Write([]byte("+OK\r\n1 a1\r\n.\r\n"))
+			case line == "RETR 1\r\n":
+				conn.Write([]byte("+OK\r\n" + message + ".\r\n"))
+			default:
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}
+	}()
+
+	pop3Seen.Initialized = true
+	config := &emailConfig{
+		from:       "rss@example.com",
+		pop3Server: ln.Addr().String(),
+		pop3TLS:    tlsPlain,
+		username:   "rss",
+		password:   "secret",
+		dryRun:     true,
+		dryRunDir:  filepath.Join(dir, "out"),
+	}
+	if err := fetchPOP3(config); err != nil {
+		t.Fatal(err)
+	}
+
+	userSubscription, ok := userSubscriptions.m["a@example.com"]
+	if !ok {
+		t.Fatal("subscribe over pop3 subscribed nothing")
+	}
+	for _, url := range []string{"https://example.com/feed.xml", "https://example.com/rss"} {
+		if _, ok := (*userSubscription)[url]; !ok {
+			t.Errorf("%s not subscribed", url)
+		}
+	}
+}
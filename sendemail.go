@@ -4,114 +4,320 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
-	"errors"
 	"html"
 	"log"
 	"mime/quotedprintable"
-	"net/smtp"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/mmcdole/gofeed"
 )
 
 const feedSubject = "[rss-email] feed"
 
-const mailTemplate = `To: {{.To}}
+// digest formats users can pick with the format command
+const (
+	formatHTML = "html"
+	formatText = "text"
+)
+
+// the content types of formatHTML and formatText
+const (
+	contentHTML = "text/html"
+	contentText = "text/plain"
+)
+
+const mailTemplate = `From: {{.From}}
+To: {{.To}}
 Subject: {{.Subject}}
-Content-Type: text/html; charset="UTF-8"
+Date: {{.Date}}
+Message-ID: {{.MessageID}}
+MIME-Version: 1.0
+{{if .Multipart}}Content-Type: {{.ContentType}}
+{{else}}Content-Type: {{.ContentType}}; charset="UTF-8"
 Content-Transfer-Encoding: quoted-printable
-
+{{end}}
 {{.Body}}
 `
 
 type templateParams struct {
-	To      string
-	Subject string
-	Body    string
+	From        string
+	To          string
+	Subject     string
+	Date        string
+	MessageID   string
+	ContentType string
+	// the body is a multipart of its own encoded parts
+	Multipart bool
+	Body      string
 }
 
-func sendSubscription(config *emailConfig) error {
-	for to, userUrls := range userSubscriptions.m {
-		param := &bodyParam{}
-		var urlHashMap = make(map[string]string)
+// digest collects the feeds of one user going to one destination.
+type digest struct {
+	to       string
+	via      string
+	dest     string
+	param    *bodyParam
+	template string
+	format   string
+	sort     string
+	images   string
+	limits   digestLimits
+	// feed url to the hash committed once delivered
+	commits map[string]string
 
-		for url, userURLInfo := range *userUrls {
-			urlInfo, ok := subscription.m[url]
-			if !ok {
-				return errors.New("feed url not in map")
-			}
+	// the rendered body, see renderDigests
+	body        string
+	contentType string
+}
 
-			// make sure we have populated feed
-			if urlInfo.lastUpdate.IsZero() {
-				continue
-			}
+// sendLock serializes sending. A digest is composed once the previous one is
+// accepted, see pendingDigest, so no other send may queue one meanwhile.
+var sendLock sync.Mutex
 
-			filteredFeed, nextHash, err := filterFeed(urlInfo.feed, userURLInfo)
-			if err != nil {
-				log.Print(err)
-				continue
-			}
-			param.Feeds = append(param.Feeds, filteredFeed)
-			urlHashMap[url] = nextHash
+// sendSubscription queues what's new to users, to every user when none is
+// given. The digests are rendered under userSubscriptions lock and
+// subscription read lock, their images and enclosures are downloaded once
+// both are released.
+func sendSubscription(config *emailConfig, users ...string) error {
+	sendLock.Lock()
+	defer sendLock.Unlock()
+
+	userSubscriptions.Lock()
+	subscription.RLock()
+	if len(users) == 0 {
+		for to := range userSubscriptions.m {
+			users = append(users, to)
+		}
+	}
+	var digests []*digest
+	var err error
+	for _, to := range users {
+		userUrls, ok := userSubscriptions.m[to]
+		if !ok || userSubscriptions.pref(to).Suspended != "" {
+			continue
+		}
+		var rendered []*digest
+		if rendered, err = renderDigests(config, to, userUrls); err != nil {
+			break
 		}
+		digests = append(digests, rendered...)
+	}
+	subscription.RUnlock()
+	userSubscriptions.Unlock()
+	if err != nil {
+		return err
+	}
 
-		// make sure we have contents to send
-		var itemNum int
-		for _, feed := range param.Feeds {
-			itemNum += len(feed.Items)
+	for _, d := range digests {
+		if err := queueDigest(config, d); err != nil {
+			return err
 		}
-		if itemNum == 0 {
-			return nil
+	}
+	return nil
+}
+
+// renderDigests queues the webhooks of one user and returns the rendered
+// digests with something new, caller must hold userSubscriptions lock and
+// subscription read lock.
+func renderDigests(config *emailConfig, to string, userUrls *userSubscriptionType) ([]*digest, error) {
+	if err := queueWebhooks(config, to, userUrls); err != nil {
+		return nil, err
+	}
+
+	// the previous digest is not accepted yet, wait for it
+	if outbox.pendingDigest(to) {
+		return nil, nil
+	}
+
+	var rendered []*digest
+	_, digests := userDigests(config, to, userUrls)
+	for _, d := range digests {
+		body, contentType, err := digestBody(config, d)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if body == "" {
+			continue
+		}
+		d.body, d.contentType = body, contentType
+		rendered = append(rendered, d)
+	}
+	return rendered, nil
+}
+
+// userDigests collects what's new to user by destination of the delivery via,
+// caller must hold userSubscriptions lock and subscription read lock.
+func userDigests(config *emailConfig, to string, userUrls *userSubscriptionType) (string, map[string]*digest) {
+	via, path := deliveryFor(config, to)
+
+	// usually a single digest, appended to one folder per tag if asked to
+	digests := make(map[string]*digest)
+	for url, userURLInfo := range *userUrls {
+		dest := path
+		if via == deliverIMAP && config.appendPerTag && userURLInfo.Tag != "" {
+			dest = path + "/" + userURLInfo.Tag
+		}
+		d, ok := digests[dest]
+		if !ok {
+			pref := userSubscriptions.pref(to)
+			d = &digest{
+				to:       to,
+				via:      via,
+				dest:     dest,
+				param:    &bodyParam{},
+				template: pref.Template,
+				format:   pref.Format,
+				sort:     pref.Sort,
+				images:   imagesFor(config, to),
+				limits:   limitsFor(config, to),
+				commits:  make(map[string]string),
+			}
+			digests[dest] = d
+		}
+		d.param.Expect++
+
+		urlInfo, ok := subscription.m[url]
+		if !ok {
+			log.Printf("feed url not in map: %s", url)
+			continue
 		}
 
-		param.Expect = len(*userUrls)
-		param.Actual = len(param.Feeds)
-		param.ShowErr = param.Expect != param.Actual
+		// make sure we have populated feed
+		if urlInfo.lastUpdate.IsZero() {
+			continue
+		}
 
-		parsedFeed, err := parsefeed(param)
+		filteredFeed, nextHash, err := filterFeed(urlInfo.feed, userURLInfo.LastHash)
 		if err != nil {
 			log.Print(err)
 			continue
 		}
+		d.param.Feeds = append(d.param.Feeds, &digestFeed{
+			Feed:     filteredFeed,
+			Tag:      userURLInfo.Tag,
+			url:      url,
+			maxItems: userURLInfo.MaxItems,
+			attach:   userURLInfo.Attach,
+		})
+		d.commits[url] = nextHash
+	}
+
+	return via, digests
+}
+
+// queueDigest completes the rendered d with its images and enclosures and
+// leaves it to the outbox. It downloads them, so callers must not hold
+// userSubscriptions lock or subscription lock.
+func queueDigest(config *emailConfig, d *digest) error {
+	parsedFeed, contentType := d.body, d.contentType
 
-		body, err := toQuotedPrintable(html.UnescapeString(parsedFeed))
+	var images []*inlineImage
+	if contentType == contentHTML {
+		parsedFeed, images = inlineImages(config, parsedFeed, d.images)
+	}
+
+	body, err := toQuotedPrintable(parsedFeed)
+	if err != nil {
+		return err
+	}
+	if len(images) > 0 {
+		body, contentType, err = relatedBody(body, images)
 		if err != nil {
 			return err
 		}
-		if err := sendemail(config, to, feedSubject, body); err != nil {
+	}
+	if files := digestAttachments(config, d.param); len(files) > 0 {
+		body, contentType, err = mixedBody(body, contentType, files)
+		if err != nil {
 			return err
 		}
+	}
+	msg, err := composeMessage(config, d.to, feedSubject, contentType, body)
+	if err != nil {
+		return err
+	}
 
-		// Update visited hash
-		for url, hash := range urlHashMap {
-			(*userUrls)[url].LastHash = hash
-		}
+	// visited hash is updated once the message is delivered
+	return queueMessage(config, &outboxMessage{To: d.to, Via: d.via, Path: d.dest, Data: msg, Commits: d.commits})
+}
+
+// digestBody renders the body of d and returns it with its content type, it's
+// empty when there is nothing new.
+func digestBody(config *emailConfig, d *digest) (string, string, error) {
+	param := d.param
+
+	// make sure we have contents to send
+	var itemNum int
+	for _, feed := range param.Feeds {
+		itemNum += len(feed.Items)
+	}
+	if itemNum == 0 {
+		return "", "", nil
 	}
 
-	return nil
+	param.Actual = len(param.Feeds)
+	param.ShowErr = param.Expect != param.Actual
+	sortDigest(param, d.sort)
+	limitDigest(param, d.limits)
+
+	if d.format == formatText {
+		body, err := parsefeedText(config, param)
+		return body, contentText, err
+	}
+	body, err := parsefeed(config, d.template, param)
+	return html.UnescapeString(body), contentHTML, err
+}
+
+// queueEmail composes a message and leaves it to the outbox for delivery,
+// caller must hold userSubscriptions lock. Replies to senders who aren't
+// subscribed are emailed, the deployment's local delivery is for users only.
+func queueEmail(config *emailConfig, to, subject, body string) error {
+	msg, err := composeMessage(config, to, subject, contentHTML, body)
+	if err != nil {
+		return err
+	}
+
+	via, path := deliveryFor(config, to)
+	if _, ok := userSubscriptions.m[to]; !ok && via != deliverSMTP {
+		if config.smtpServer == "" {
+			log.Printf("no reply to %s, not subscribed and no smtpServer", to)
+			return nil
+		}
+		via, path = deliverSMTP, ""
+	}
+	return queueMessage(config, &outboxMessage{To: to, Via: via, Path: path, Data: msg})
 }
 
-func sendemail(config *emailConfig, to, subject, body string) error {
+func composeMessage(config *emailConfig, to, subject, contentType, body string) ([]byte, error) {
 	src := strings.ReplaceAll(mailTemplate, "\n", "\r\n")
 
+	domain := "localhost"
+	if i := strings.LastIndex(config.from, "@"); i >= 0 {
+		domain = config.from[i+1:]
+	}
+
 	t := template.Must(template.New("mailTemplate").Parse(src))
 	msg := &bytes.Buffer{}
-	params := templateParams{to, subject, body}
-	err := t.Execute(msg, params)
-	if err != nil {
-		return err
+	params := templateParams{
+		From:        config.from,
+		To:          to,
+		Subject:     subject,
+		Date:        time.Now().Format(time.RFC1123Z),
+		MessageID:   "<" + newOutboxID() + "@" + domain + ">",
+		ContentType: contentType,
+		Multipart:   strings.HasPrefix(contentType, "multipart/"),
+		Body:        body,
 	}
-	auth := LOGINAuth(config.username, config.password)
-
-	err = smtp.SendMail(config.smtpServer, auth, config.from, []string{to}, msg.Bytes())
+	err := t.Execute(msg, params)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Printf("one email sent to %s", to)
-
-	return nil
+	return msg.Bytes(), nil
 }
 
 func toQuotedPrintable(s string) (string, error) {
@@ -128,7 +334,9 @@ func toQuotedPrintable(s string) (string, error) {
 	return buf.String(), nil
 }
 
-func filterFeed(feed *gofeed.Feed, userURLInfo *userURLInfo) (*gofeed.Feed, string, error) {
+// filterFeed returns feed with only the items newer than the one hashed to
+// lastHash, and the hash of the newest item.
+func filterFeed(feed *gofeed.Feed, lastHash string) (*gofeed.Feed, string, error) {
 	var res = new(gofeed.Feed)
 	*res = *feed
 
@@ -149,7 +357,7 @@ func filterFeed(feed *gofeed.Feed, userURLInfo *userURLInfo) (*gofeed.Feed, stri
 		if index == 0 {
 			nextHash = hexSha1
 		}
-		if hexSha1 == userURLInfo.LastHash {
+		if hexSha1 == lastHash {
 			res.Items = res.Items[:index]
 			break
 		}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+var errDailyQuota = errors.New("daily sending quota exhausted")
+
+// smtpSession keeps one authenticated connection to the relay, so a send
+// cycle authenticates once instead of once per message.
+type smtpSession struct {
+	config *emailConfig
+	client *smtp.Client
+	// a transaction has been run on client, RSET before the next one
+	used bool
+}
+
+func newSMTPSession(config *emailConfig) *smtpSession {
+	return &smtpSession{config: config}
+}
+
+func (session *smtpSession) dial() error {
+	config := session.config
+	host, _, err := net.SplitHostPort(config.smtpServer)
+	if err != nil {
+		host = config.smtpServer
+	}
+
+	tlsConf, err := config.tlsConfig(host)
+	if err != nil {
+		return err
+	}
+
+	var c *smtp.Client
+	if config.smtpTLS == tlsImplicit {
+		conn, err := tls.Dial("tcp", config.smtpServer, tlsConf)
+		if err != nil {
+			return err
+		}
+		c, err = smtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		c, err = smtp.Dial(config.smtpServer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := c.Hello("localhost"); err != nil {
+		c.Close()
+		return err
+	}
+	encrypted := config.smtpTLS == tlsImplicit || config.smtpTLS == tlsStartTLS
+	if config.smtpTLS == tlsStartTLS || config.smtpTLS == tlsOpportunistic {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && config.smtpTLS == tlsStartTLS {
+			c.Close()
+			return errors.New("smtp server doesn't support STARTTLS")
+		}
+		if ok {
+			if err := c.StartTLS(tlsConf); err != nil {
+				c.Close()
+				return err
+			}
+			encrypted = true
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		if !encrypted && config.smtpTLS != tlsPlain {
+			c.Close()
+			return errCleartextLogin
+		}
+		if err := c.Auth(LOGINAuth(config.username, config.password)); err != nil {
+			c.Close()
+			return err
+		}
+	}
+
+	session.client = c
+	session.used = false
+	return nil
+}
+
+// send delivers msg to to, reconnecting once if the connection was lost.
+func (session *smtpSession) send(to string, msg []byte) error {
+	err := session.transmit(to, msg)
+	if err == nil {
+		return nil
+	}
+
+	// the relay answered, the connection is still usable
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return err
+	}
+
+	log.Printf("smtp connection lost, reconnecting: %v", err)
+	session.close()
+	return session.transmit(to, msg)
+}
+
+func (session *smtpSession) transmit(to string, msg []byte) error {
+	if session.client == nil {
+		if err := session.dial(); err != nil {
+			return err
+		}
+	}
+
+	c := session.client
+	if session.used {
+		if err := c.Reset(); err != nil {
+			return err
+		}
+	}
+	session.used = true
+
+	if err := c.Mail(session.config.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("one email sent to %s", to)
+
+	return nil
+}
+
+func (session *smtpSession) close() {
+	if session.client == nil {
+		return
+	}
+	if err := session.client.Quit(); err != nil {
+		session.client.Close()
+	}
+	session.client = nil
+}
+
+// smtpQuota enforces the configured messages-per-minute and per-day limits.
+// The daily count is persisted along with the outbox.
+type smtpQuota struct {
+	Day  string
+	Sent int
+
+	minute []time.Time
+}
+
+// delay returns how long to wait before one more message fits in the
+// per-minute limit, or errDailyQuota when today's limit is reached.
+func (quota *smtpQuota) delay(config *emailConfig) (time.Duration, error) {
+	now := time.Now()
+	if day := now.Format("2006-01-02"); quota.Day != day {
+		quota.Day = day
+		quota.Sent = 0
+	}
+	if config.smtpPerDay > 0 && quota.Sent >= config.smtpPerDay {
+		return 0, errDailyQuota
+	}
+
+	if config.smtpPerMinute <= 0 {
+		return 0, nil
+	}
+
+	var recent []time.Time
+	for _, t := range quota.minute {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	quota.minute = recent
+
+	if len(quota.minute) < config.smtpPerMinute {
+		return 0, nil
+	}
+	return quota.minute[len(quota.minute)-config.smtpPerMinute].Add(time.Minute).Sub(now), nil
+}
+
+// record counts one message handed to the relay.
+func (quota *smtpQuota) record() {
+	quota.Sent++
+	quota.minute = append(quota.minute, time.Now())
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpReply answers like a relay offering AUTH but no STARTTLS, recipients
+// containing a key of reject get its reply.
+func smtpReply(reject map[string]string) func(line string) string {
+	var data bool
+	return func(line string) string {
+		if data {
+			if line == ".\r\n" {
+				data = false
+				return "250 queued\r\n"
+			}
+			return ""
+		}
+		switch {
+		case strings.HasPrefix(line, "EHLO"):
+			return "250-fake\r\n250 AUTH LOGIN\r\n"
+		case strings.HasPrefix(line, "AUTH"):
+			return "235 ok\r\n"
+		case strings.HasPrefix(line, "RCPT"):
+			for to, reply := range reject {
+				if strings.Contains(line, to) {
+					return reply
+				}
+			}
+		case strings.HasPrefix(line, "DATA"):
+			data = true
+			return "354 go on\r\n"
+		case strings.HasPrefix(line, "QUIT"):
+			return "221 bye\r\n"
+		}
+		return "250 ok\r\n"
+	}
+}
+
+// smtpCommands returns the smtp commands among lines, leaving out messages.
+func smtpCommands(lines []string) []string {
+	var verbs []string
+	for _, line := range lines {
+		switch verb := strings.Fields(line + " x")[0]; verb {
+		case "EHLO", "HELO", "AUTH", "MAIL", "RCPT", "DATA", "RSET", "QUIT":
+			verbs = append(verbs, verb)
+		}
+	}
+	return verbs
+}
+
+func Test_smtpQuota(t *testing.T) {
+	now := time.Now()
+	today := now.Format("2006-01-02")
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	tests := []struct {
+		name      string
+		perMinute int
+		perDay    int
+		quota     smtpQuota
+		wantErr   error
+		wantDelay time.Duration
+		wantSent  int
+	}{
+		{"no limits", 0, 0, smtpQuota{Day: today, Sent: 1000}, nil, 0, 1000},
+		{"under the daily limit", 0, 10, smtpQuota{Day: today, Sent: 9}, nil, 0, 9},
+		{"daily limit reached", 0, 10, smtpQuota{Day: today, Sent: 10}, errDailyQuota, 0, 10},
+		{"limit of yesterday", 0, 10, smtpQuota{Day: "2000-01-01", Sent: 10}, nil, 0, 0},
+		{"minute not full", 2, 0, smtpQuota{Day: today, minute: []time.Time{ago(time.Second)}}, nil, 0, 0},
+		{"minute full", 2, 0, smtpQuota{Day: today, minute: []time.Time{ago(40 * time.Second), ago(10 * time.Second)}}, nil, 20 * time.Second, 0},
+		{"older sends expire", 2, 0, smtpQuota{Day: today, minute: []time.Time{ago(2 * time.Minute), ago(10 * time.Second)}}, nil, 0, 0},
+	}
+	for _, tt := range tests {
+		quota := tt.quota
+		delay, err := quota.delay(&emailConfig{smtpPerMinute: tt.perMinute, smtpPerDay: tt.perDay})
+		if err != tt.wantErr {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.wantErr)
+		}
+		// allow for the time the test takes
+		if delay > tt.wantDelay || delay < tt.wantDelay-time.Second {
+			t.Errorf("%s: delay %v, want %v", tt.name, delay, tt.wantDelay)
+		}
+		if quota.Sent != tt.wantSent {
+			t.Errorf("%s: sent %d, want %d", tt.name, quota.Sent, tt.wantSent)
+		}
+	}
+
+	// record fills the limits delay checks
+	config := &emailConfig{smtpPerMinute: 1, smtpPerDay: 2}
+	var quota smtpQuota
+	for i, want := range []error{nil, nil, errDailyQuota} {
+		delay, err := quota.delay(config)
+		if err != want {
+			t.Errorf("send %d: error %v, want %v", i, err, want)
+		}
+		if i == 1 && delay <= 0 {
+			t.Errorf("send %d: no delay with the minute full", i)
+		}
+		quota.record()
+	}
+}
+
+func Test_smtpSession(t *testing.T) {
+	addr, received := lineServer(t, "220 fake\r\n", smtpReply(nil))
+	session := newSMTPSession(&emailConfig{from: "rss@example.com", smtpServer: addr, smtpTLS: tlsPlain})
+	defer session.close()
+
+	for _, to := range []string{"a@example.com", "b@example.com"} {
+		if err := session.send(to, []byte("Subject: hi\r\n\r\nhi\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the connection is lost between cycles of the outbox
+	session.client.Close()
+	if err := session.send("c@example.com", []byte("Subject: hi\r\n\r\nhi\r\n")); err != nil {
+		t.Fatalf("send after a lost connection: %v", err)
+	}
+
+	want := []string{
+		"EHLO", "AUTH", "MAIL", "RCPT", "DATA",
+		// one login, RSET between transactions
+		"RSET", "MAIL", "RCPT", "DATA",
+		// RSET fails on the closed connection, a new one is made
+		"EHLO", "AUTH", "MAIL", "RCPT", "DATA",
+	}
+	if got := smtpCommands(received()); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("commands\n%v\nwant\n%v", got, want)
+	}
+}
+
+func Test_drainRecordsAcceptedOnly(t *testing.T) {
+	keepState(t)
+	addr, _ := lineServer(t, "220 fake\r\n", smtpReply(map[string]string{
+		"later@": "451 try again later\r\n",
+		"never@": "550 no such user\r\n",
+	}))
+	config := &emailConfig{from: "rss@example.com", smtpServer: addr, smtpTLS: tlsPlain, smtpPerDay: 10}
+
+	for _, to := range []string{"a@example.com", "later@example.com", "never@example.com"} {
+		if err := outbox.enqueue(&outboxMessage{To: to, Via: deliverSMTP, Data: []byte("Subject: hi\r\n\r\nhi\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := outbox.drain(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if outbox.Quota.Sent != 1 || len(outbox.Quota.minute) != 1 {
+		t.Errorf("quota counted %d sends, %d this minute, want only the accepted one", outbox.Quota.Sent, len(outbox.Quota.minute))
+	}
+	if outbox.depth() != 1 || len(outbox.Failed) != 1 {
+		t.Errorf("%d pending, %d failed, want the temporary failure pending", outbox.depth(), len(outbox.Failed))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// keepState gives the test empty package state, saved to a temporary data
+// directory which is returned. The state before is restored on cleanup, so
+// tests don't depend on their order.
+func keepState(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rss-email")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []*string{&savedFilePath, &preferencesFilePath, &outboxFilePath, &checkpointFilePath, &pop3SeenFilePath}
+	var savedPaths []string
+	for _, p := range paths {
+		savedPaths = append(savedPaths, *p)
+	}
+	users, prefs := userSubscriptions.m, userSubscriptions.prefs
+	feeds := subscription.m
+	pending, failed, quota := outbox.Pending, outbox.Failed, outbox.Quota
+	savedCheckpoints, savedPOP3Seen := checkpoints, pop3Seen
+	t.Cleanup(func() {
+		for i, p := range paths {
+			*p = savedPaths[i]
+		}
+		userSubscriptions.m, userSubscriptions.prefs = users, prefs
+		subscription.m = feeds
+		outbox.Pending, outbox.Failed, outbox.Quota = pending, failed, quota
+		checkpoints, pop3Seen = savedCheckpoints, savedPOP3Seen
+		os.RemoveAll(dir)
+	})
+
+	setDataDir(dir)
+	userSubscriptions.m, userSubscriptions.prefs = make(map[string]*userSubscriptionType), make(map[string]*userPreference)
+	subscription.m = make(map[string]*urlInfo)
+	outbox.Pending, outbox.Failed, outbox.Quota = nil, nil, smtpQuota{}
+	checkpoints, pop3Seen = newMailboxCheckpoints(), newPOP3Seen()
+	return dir
+}
@@ -14,9 +14,21 @@ import (
 )
 
 var savedFilePath = path.Join("/", "rss-email", "user")
+var preferencesFilePath = path.Join("/", "rss-email", "preferences")
 
 type userURLInfo struct {
 	LastHash string
+	// Tag groups feeds of one user, see the tag command
+	Tag string `json:",omitempty"`
+	// Webhook receives new items of this feed, WebhookHash is its position
+	// in the feed like LastHash is the digest's
+	Webhook     string `json:",omitempty"`
+	WebhookHash string `json:",omitempty"`
+	// MaxItems caps full items of this feed per digest, see digestLimits
+	MaxItems int `json:",omitempty"`
+	// Attach small enclosures of this feed to the digest, see the attach
+	// command
+	Attach bool `json:",omitempty"`
 }
 
 func newUserURLInfo() *userURLInfo {
@@ -35,20 +47,80 @@ func (userSubscription *userSubscriptionType) printToUser() (str string, err err
 
 	str += "<div>subscribed RSS url list:</div>"
 
-	for k := range *userSubscription {
-		str += "<div>" + k + "</div>"
+	for k, v := range *userSubscription {
+		line := k
+		if v.Tag != "" {
+			line += " [" + v.Tag + "]"
+		}
+		if v.Attach {
+			line += " (enclosures attached)"
+		}
+		str += "<div>" + line + "</div>"
 	}
 
 	return str, nil
 }
 
+// userPreference holds the settings of one user, zero values fall back to the
+// deployment's flags.
+type userPreference struct {
+	// how digests are delivered, see deliveryFor
+	Delivery     string `json:",omitempty"`
+	DeliveryPath string `json:",omitempty"`
+	// receives new items of every feed without a webhook of its own
+	Webhook string `json:",omitempty"`
+	// signs the user's webhook requests, see userWebhookSecret
+	WebhookSecret string `json:",omitempty"`
+	// the error of a digest or webhook given up on, nothing is sent until
+	// the user sends a command again, see suspendFailed
+	Suspended string `json:",omitempty"`
+	// names the user's personal feeds, see handlePersonalFeed
+	Token string `json:",omitempty"`
+	// the digest template, see knownTemplates
+	Template string `json:",omitempty"`
+	// formatHTML or formatText, empty is formatHTML
+	Format string `json:",omitempty"`
+	// the order of feeds in digests, see sortDigest
+	Sort string `json:",omitempty"`
+	// imagesRemote, imagesStrip or imagesEmbed, see imagesFor
+	Images string `json:",omitempty"`
+	// digest limits, see limitsFor
+	MaxFeedItems  int `json:",omitempty"`
+	MaxItems      int `json:",omitempty"`
+	Truncate      int `json:",omitempty"`
+	MaxDigestSize int `json:",omitempty"`
+}
+
 type userSubscriptionsType struct {
 	sync.RWMutex
-	m map[string]*userSubscriptionType
+	m     map[string]*userSubscriptionType
+	prefs map[string]*userPreference
 }
 
 func newUserSubscriptions() userSubscriptionsType {
-	return userSubscriptionsType{m: make(map[string]*userSubscriptionType)}
+	return userSubscriptionsType{
+		m:     make(map[string]*userSubscriptionType),
+		prefs: make(map[string]*userPreference),
+	}
+}
+
+// pref returns the preferences of user, caller must hold the lock.
+func (userSubscriptions *userSubscriptionsType) pref(user string) *userPreference {
+	if pref, ok := userSubscriptions.prefs[user]; ok {
+		return pref
+	}
+	return &userPreference{}
+}
+
+// setPref returns the preferences of user for modification, caller must hold
+// the lock.
+func (userSubscriptions *userSubscriptionsType) setPref(user string) *userPreference {
+	pref, ok := userSubscriptions.prefs[user]
+	if !ok {
+		pref = &userPreference{}
+		userSubscriptions.prefs[user] = pref
+	}
+	return pref
 }
 
 // save userSubscription.m to disc.
@@ -74,7 +146,12 @@ func (userSubscriptions *userSubscriptionsType) saveToDisk() error {
 		return err
 	}
 
-	return nil
+	b, err = json.Marshal(userSubscriptions.prefs)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(preferencesFilePath, b, 0600)
 }
 
 // save userSubscription.m to disc.
@@ -98,7 +175,15 @@ func (userSubscriptions *userSubscriptionsType) restoreFromDisk() error {
 		return err
 	}
 
-	return nil
+	b, err = ioutil.ReadFile(preferencesFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, &userSubscriptions.prefs)
 }
 
 type urlInfo struct {
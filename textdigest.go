@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// the template rendering plain text digests
+const textTemplate = "text"
+
+// textParam is bodyParam converted to plain text, links are footnotes.
+type textParam struct {
+	Expect  int
+	Actual  int
+	ShowErr bool
+	// Feeds in order, Groups has them by tag
+	Feeds  []textFeed
+	Groups []textGroup
+	Links  []textLink
+}
+
+type textGroup struct {
+	Tag   string
+	Count int
+	Feeds []textFeed
+}
+
+type textFeed struct {
+	Title     string
+	Count     int
+	Underline string
+	Ref       string
+	Items     []textItem
+	// headlines beyond the digest limits, only Title and Ref are set
+	More    []textItem
+	Omitted int
+}
+
+type textItem struct {
+	Title string
+	Ref   string
+	Date  string
+	Body  string
+	// e.g. "audio/mpeg, 12.3 MB, 1:02:03 [4]"
+	Enclosures []string
+}
+
+type textLink struct {
+	N   int
+	URL string
+}
+
+func newTextParam(param *bodyParam) *textParam {
+	notes := &footnotes{}
+	text := &textParam{Expect: param.Expect, Actual: param.Actual, ShowErr: param.ShowErr}
+
+	for _, group := range param.Groups {
+		g := textGroup{Tag: group.Tag, Count: group.Count}
+		for _, feed := range group.Feeds {
+			f := newTextFeed(feed, notes)
+			g.Feeds = append(g.Feeds, f)
+			text.Feeds = append(text.Feeds, f)
+		}
+		text.Groups = append(text.Groups, g)
+	}
+
+	for i, link := range notes.links {
+		text.Links = append(text.Links, textLink{i + 1, link})
+	}
+	return text
+}
+
+func newTextFeed(feed *digestFeed, notes *footnotes) textFeed {
+	heading := feed.Title + " (" + strconv.Itoa(feed.Count) + ")"
+	f := textFeed{
+		Title:     feed.Title,
+		Count:     feed.Count,
+		Underline: strings.Repeat("=", utf8.RuneCountInString(heading)),
+		Omitted:   feed.Omitted,
+	}
+	if feed.Link != "" {
+		f.Ref = notes.ref(feed.Link)
+	}
+
+	for _, item := range feed.Items {
+		i := textItem{Title: item.Title}
+		if item.Link != "" {
+			i.Ref = notes.ref(item.Link)
+		}
+		if item.PublishedParsed != nil {
+			i.Date = item.PublishedParsed.Format("15:04 Jan 2")
+		}
+		// Description is mostly a summary of Content
+		body := htmlToText(itemContent(item.Content, item.Description), notes)
+		i.Body = wrapText(body, textWidth, "  ")
+		for _, enclosure := range item.Enclosures {
+			i.Enclosures = append(i.Enclosures, enclosureText(item, enclosure, notes))
+		}
+		f.Items = append(f.Items, i)
+	}
+	for _, item := range feed.More {
+		i := textItem{Title: item.Title}
+		if item.Link != "" {
+			i.Ref = notes.ref(item.Link)
+		}
+		f.More = append(f.More, i)
+	}
+	return f
+}
+
+// enclosureText describes an enclosure of item in one line.
+func enclosureText(item *gofeed.Item, enclosure *gofeed.Enclosure, notes *footnotes) string {
+	parts := []string{enclosure.Type}
+	if enclosure.Type == "" {
+		parts[0] = "file"
+	}
+	if size := byteSize(enclosure.Length); size != "" {
+		parts = append(parts, size)
+	}
+	if duration := itemDuration(item); duration != "" {
+		parts = append(parts, duration)
+	}
+	text := strings.Join(parts, ", ")
+	if enclosure.URL != "" {
+		text += " " + notes.ref(enclosure.URL)
+	}
+	return text
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func Test_htmlToText(t *testing.T) {
+	notes := &footnotes{}
+	got := htmlToText(`<p>Read <a href="https://example.com/a">this</a> &amp; <b>that</b>.</p>
+<ul><li>one</li><li>two <a href="https://example.com/a">again</a></li></ul><script>alert(1)</script><img src="x.png" alt="chart">`, notes)
+	want := "Read this [1] & that.\n\n- one\n- two again [1]\n\n[chart]"
+	if got != want {
+		t.Errorf("htmlToText = %q, want %q", got, want)
+	}
+	if len(notes.links) != 1 || notes.links[0] != "https://example.com/a" {
+		t.Errorf("footnotes %q", notes.links)
+	}
+}
+
+func Test_wrapText(t *testing.T) {
+	got := wrapText("aaa bbb ccc ddd\n\nverylongword", 9, "  ")
+	want := "  aaa bbb\n  ccc ddd\n\n  verylongword"
+	if got != want {
+		t.Errorf("wrapText = %q, want %q", got, want)
+	}
+}
+
+func Test_parsefeedText(t *testing.T) {
+	published := time.Date(2020, 4, 23, 10, 0, 0, 0, time.UTC)
+	param := &bodyParam{Expect: 1, Actual: 1, Feeds: []*digestFeed{{Feed: &gofeed.Feed{
+		Title: "Blog",
+		Link:  "https://blog.example.com",
+		Items: []*gofeed.Item{{
+			Title:           "Post",
+			Link:            "https://blog.example.com/post",
+			Description:     "<p>the summary</p>",
+			Content:         `<p>the <a href="https://example.com">whole</a> post</p>`,
+			PublishedParsed: &published,
+		}},
+	}}}}
+	sortDigest(param, defaultSort)
+
+	templateCache.reset()
+	got, err := parsefeedText(&emailConfig{}, param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Blog (1) [1]\n========\n",
+		"* Post [2]\n  10:00 Apr 23\n\n  the whole [3] post\n",
+		"Links:\n[1] https://blog.example.com\n[2] https://blog.example.com/post\n[3] https://example.com\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("text digest lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "summary") || strings.Contains(got, "<") {
+		t.Errorf("text digest has the summary or html:\n%s", got)
+	}
+}
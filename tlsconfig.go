@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// transport security modes, chosen independently for SMTP and IMAP
+const (
+	// TLS from the first byte, e.g. SMTPS on port 465 or IMAPS on 993
+	tlsImplicit = "implicit"
+	// upgrade with STARTTLS, fail if the server doesn't offer it
+	tlsStartTLS = "starttls"
+	// upgrade with STARTTLS when the server offers it
+	tlsOpportunistic = "opportunistic"
+	// no TLS at all, only for local test relays
+	tlsPlain = "plain"
+)
+
+// errCleartextLogin keeps the password off connections the server didn't let
+// us encrypt, only the plain mode sends it in the clear.
+var errCleartextLogin = errors.New("server doesn't offer STARTTLS, refusing to log in unencrypted, use plain to allow it")
+
+func validTLSMode(mode string) bool {
+	switch mode {
+	case tlsImplicit, tlsStartTLS, tlsOpportunistic, tlsPlain:
+		return true
+	}
+	return false
+}
+
+// tlsConfig builds the client TLS settings for serverName from the CA bundle,
+// client certificate and verification flags.
+func (config *emailConfig) tlsConfig(serverName string) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: config.insecureSkipVerify,
+	}
+
+	if config.tlsCA != "" {
+		pem, err := ioutil.ReadFile(config.tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + config.tlsCA)
+		}
+		tlsConf.RootCAs = pool
+	}
+
+	if config.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.tlsCert, config.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConf, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_validTLSMode(t *testing.T) {
+	tests := map[string]bool{
+		tlsImplicit:      true,
+		tlsStartTLS:      true,
+		tlsOpportunistic: true,
+		tlsPlain:         true,
+		"":               false,
+		"tls":            false,
+		"STARTTLS":       false,
+	}
+	for mode, want := range tests {
+		if got := validTLSMode(mode); got != want {
+			t.Errorf("validTLSMode(%q) = %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func Test_tlsDefaults(t *testing.T) {
+	config, _, err := parseConfig(nil, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ name, got, want string }{
+		{"smtpTLS", config.smtpTLS, tlsOpportunistic},
+		{"imapTLS", config.imapTLS, tlsImplicit},
+		{"pop3TLS", config.pop3TLS, tlsImplicit},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("default %s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// writeCertificate writes a self-signed certificate and its key as PEM files
+// to dir.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rss-email test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func Test_tlsConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	missing := filepath.Join(dir, "missing.pem")
+
+	tests := []struct {
+		name      string
+		config    emailConfig
+		wantErr   bool
+		wantRoots bool
+		wantCerts int
+	}{
+		{"system pool", emailConfig{}, false, false, 0},
+		{"insecure", emailConfig{insecureSkipVerify: true}, false, false, 0},
+		{"ca", emailConfig{tlsCA: certFile}, false, true, 0},
+		{"missing ca", emailConfig{tlsCA: missing}, true, false, 0},
+		{"ca without certificate", emailConfig{tlsCA: keyFile}, true, false, 0},
+		{"client certificate", emailConfig{tlsCert: certFile, tlsKey: keyFile}, false, false, 1},
+		{"client certificate without key", emailConfig{tlsCert: certFile, tlsKey: missing}, true, false, 0},
+		{"ca and client certificate", emailConfig{tlsCA: certFile, tlsCert: certFile, tlsKey: keyFile}, false, true, 1},
+	}
+	for _, tt := range tests {
+		tlsConf, err := tt.config.tlsConfig("mail.example.com")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if tlsConf.ServerName != "mail.example.com" || tlsConf.InsecureSkipVerify != tt.config.insecureSkipVerify {
+			t.Errorf("%s: server name %q, insecure %v", tt.name, tlsConf.ServerName, tlsConf.InsecureSkipVerify)
+		}
+		if (tlsConf.RootCAs != nil) != tt.wantRoots {
+			t.Errorf("%s: custom roots %v, want %v", tt.name, tlsConf.RootCAs != nil, tt.wantRoots)
+		}
+		if len(tlsConf.Certificates) != tt.wantCerts {
+			t.Errorf("%s: %d client certificates, want %d", tt.name, len(tlsConf.Certificates), tt.wantCerts)
+		}
+	}
+}
+
+// lineServer accepts connections on a local port, greets them and answers
+// every line with reply, which is called by one connection at a time. It
+// returns the address and the lines received.
+func lineServer(t *testing.T, greeting string, reply func(line string) string) (string, func() []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	var lines []string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(greeting))
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					lines = append(lines, line)
+					answer := reply(line)
+					mu.Unlock()
+					conn.Write([]byte(answer))
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), lines...)
+	}
+}
+
+func Test_cleartextLogin(t *testing.T) {
+	pop3Reply := func(line string) string {
+		if strings.HasPrefix(line, "STLS") {
+			return "-ERR not supported\r\n"
+		}
+		return "+OK\r\n"
+	}
+	imapReply := func(line string) string {
+		tag := strings.Fields(line)[0]
+		return "* BYE bye\r\n" + tag + " OK done\r\n"
+	}
+	smtpAddr, smtpLines := lineServer(t, "220 fake\r\n", smtpReply(nil))
+	pop3Addr, pop3Lines := lineServer(t, "+OK fake\r\n", pop3Reply)
+	imapAddr, imapLines := lineServer(t, "* OK [CAPABILITY IMAP4rev1] fake\r\n", imapReply)
+
+	dial := map[string]func(mode string) error{
+		"smtp": func(mode string) error {
+			session := newSMTPSession(&emailConfig{smtpServer: smtpAddr, smtpTLS: mode, username: "rss", password: "secret"})
+			defer session.close()
+			return session.dial()
+		},
+		"pop3": func(mode string) error {
+			c, err := dialPOP3(&emailConfig{pop3Server: pop3Addr, pop3TLS: mode})
+			if err == nil {
+				c.conn.Close()
+			}
+			return err
+		},
+		"imap": func(mode string) error {
+			c, err := dialIMAP(&emailConfig{imapServer: imapAddr, imapTLS: mode})
+			if err == nil {
+				c.Logout()
+			}
+			return err
+		},
+	}
+	received := map[string]func() []string{"smtp": smtpLines, "pop3": pop3Lines, "imap": imapLines}
+
+	tests := []struct {
+		protocol, mode string
+		want           error
+	}{
+		{"smtp", tlsOpportunistic, errCleartextLogin},
+		{"pop3", tlsOpportunistic, errCleartextLogin},
+		{"imap", tlsOpportunistic, errCleartextLogin},
+		{"smtp", tlsPlain, nil},
+		{"pop3", tlsPlain, nil},
+		{"imap", tlsPlain, nil},
+	}
+	for _, tt := range tests {
+		if err := dial[tt.protocol](tt.mode); err != tt.want {
+			t.Errorf("%s %s: dial error %v, want %v", tt.protocol, tt.mode, err, tt.want)
+		}
+	}
+
+	// the refused dials came first, nothing before the plain ones logged in
+	for _, line := range received["pop3"]() {
+		if strings.HasPrefix(line, "USER") || strings.HasPrefix(line, "PASS") {
+			t.Errorf("pop3 sent %q", line)
+		}
+	}
+	var auths int
+	for _, line := range received["smtp"]() {
+		if strings.HasPrefix(line, "AUTH") {
+			auths++
+		}
+	}
+	if auths != 1 {
+		t.Errorf("smtp authenticated %d times, want once in plain mode", auths)
+	}
+	for _, line := range received["imap"]() {
+		if strings.Contains(line, "LOGIN") {
+			t.Errorf("imap sent %q", line)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhook requests give up after this long
+const webhookTimeout = 30 * time.Second
+
+// webhookPayload is the JSON body POSTed to webhooks.
+type webhookPayload struct {
+	Items []webhookItem `json:"items"`
+}
+
+type webhookItem struct {
+	Feed      string     `json:"feed"`
+	FeedURL   string     `json:"feed_url"`
+	Title     string     `json:"title"`
+	Link      string     `json:"link"`
+	Published *time.Time `json:"published,omitempty"`
+	Content   string     `json:"content"`
+}
+
+// webhookFor returns the webhook new items of a feed are POSTed to, the
+// feed's own taking precedence over the user's.
+func webhookFor(user string, userURLInfo *userURLInfo) string {
+	if userURLInfo.Webhook != "" {
+		return userURLInfo.Webhook
+	}
+	return userSubscriptions.pref(user).Webhook
+}
+
+// userWebhookSecret returns the secret signing the webhook requests of user,
+// creating it the first time. Caller must hold userSubscriptions lock.
+func userWebhookSecret(user string) string {
+	pref := userSubscriptions.setPref(user)
+	if pref.WebhookSecret == "" {
+		pref.WebhookSecret = newFeedToken()
+	}
+	return pref.WebhookSecret
+}
+
+// queueWebhooks leaves the items new to user's webhooks to the outbox, one
+// request per webhook. Webhooks keep their own position in each feed, apart
+// from the digest's.
+func queueWebhooks(config *emailConfig, user string, userUrls *userSubscriptionType) error {
+	if outbox.pendingWebhook(user) {
+		return nil
+	}
+
+	payloads := make(map[string]*webhookPayload)
+	commits := make(map[string]map[string]string)
+	for url, userURLInfo := range *userUrls {
+		target := webhookFor(user, userURLInfo)
+		if target == "" {
+			continue
+		}
+
+		urlInfo, ok := subscription.m[url]
+		if !ok || urlInfo.lastUpdate.IsZero() {
+			continue
+		}
+
+		filteredFeed, nextHash, err := filterFeed(urlInfo.feed, userURLInfo.WebhookHash)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if len(filteredFeed.Items) == 0 {
+			continue
+		}
+
+		if _, ok := payloads[target]; !ok {
+			payloads[target] = &webhookPayload{}
+			commits[target] = make(map[string]string)
+		}
+		// oldest first
+		for i := len(filteredFeed.Items) - 1; i >= 0; i-- {
+			item := filteredFeed.Items[i]
+			payloads[target].Items = append(payloads[target].Items, webhookItem{
+				Feed:      filteredFeed.Title,
+				FeedURL:   url,
+				Title:     item.Title,
+				Link:      item.Link,
+				Published: item.PublishedParsed,
+				Content:   itemContent(item.Content, item.Description),
+			})
+		}
+		commits[target][url] = nextHash
+	}
+
+	for target, payload := range payloads {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		msg := &outboxMessage{To: user, Via: deliverWebhook, Path: target, Data: b, Commits: commits[target]}
+		if err := queueMessage(config, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func itemContent(content, description string) string {
+	if content != "" {
+		return content
+	}
+	return description
+}
+
+// webhookDeliverer POSTs msg.Data to the webhook msg.Path.
+type webhookDeliverer struct {
+	config *emailConfig
+}
+
+func (d *webhookDeliverer) deliver(msg *outboxMessage) error {
+	userSubscriptions.RLock()
+	secret := userSubscriptions.pref(msg.To).WebhookSecret
+	userSubscriptions.RUnlock()
+
+	return postWebhook(d.config, msg.Path, msg.ID, secret, msg.Data)
+}
+
+func (d *webhookDeliverer) close() {}
+
+// postWebhook POSTs body to url signed with the user's secret:
+// X-RSS-Email-Signature holds the hex HMAC-SHA256 of the timestamp header, a
+// dot and the body. X-RSS-Email-Server-Signature is the same with
+// config.webhookSecret, when configured.
+func postWebhook(config *emailConfig, url, id, secret string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rss-email")
+	req.Header.Set("X-RSS-Email-Delivery", id)
+	req.Header.Set("X-RSS-Email-Timestamp", timestamp)
+	if secret != "" {
+		req.Header.Set("X-RSS-Email-Signature", "sha256="+signWebhook(secret, timestamp, body))
+	}
+	if config.webhookSecret != "" {
+		req.Header.Set("X-RSS-Email-Server-Signature", "sha256="+signWebhook(config.webhookSecret, timestamp, body))
+	}
+
+	resp, err := guardedClient(config, webhookTimeout).Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			return permanentError{err}
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		log.Printf("webhook %s accepted %d bytes", url, len(body))
+		return nil
+	}
+
+	err = fmt.Errorf("webhook %s answered %s", url, resp.Status)
+	// client errors won't go away by themselves, except these
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// runWebhookCommand handles "rss-email webhook URL|off|test" and returns the
+// response body. URL and off apply to the subscribed feeds listed in the
+// message body, or to the user when none is.
+func runWebhookCommand(config *emailConfig, user string, userSubscription *userSubscriptionType, msg *mail.Message, arg string) string {
+	if arg == "test" {
+		var targets []string
+		if pref := userSubscriptions.pref(user); pref.Webhook != "" {
+			targets = append(targets, pref.Webhook)
+		}
+		for _, info := range *userSubscription {
+			if info.Webhook != "" {
+				targets = append(targets, info.Webhook)
+			}
+		}
+		if len(targets) == 0 {
+			return "<div>no webhook configured</div>"
+		}
+
+		var str string
+		for _, target := range targets {
+			if err := testWebhook(config, user, target); err != nil {
+				str += "<div>" + html.EscapeString(target) + ": " + html.EscapeString(err.Error()) + "</div>"
+				continue
+			}
+			str += "<div>" + html.EscapeString(target) + ": test item queued</div>"
+		}
+		return str
+	}
+
+	target := arg
+	if target == "off" {
+		target = ""
+	} else if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "<div>not a valid http(s) url: " + html.EscapeString(arg) + "</div>"
+	}
+
+	// body is optional, without it the webhook is the user's
+	var feeds []string
+	if slurp, err := parseMultipart(msg); err == nil {
+		for _, url := range normalizeURLs(extractURLs(slurp)) {
+			if _, ok := (*userSubscription)[url]; ok {
+				feeds = append(feeds, url)
+			}
+		}
+	}
+
+	if len(feeds) == 0 {
+		userSubscriptions.setPref(user).Webhook = target
+	}
+	for _, url := range feeds {
+		(*userSubscription)[url].Webhook = target
+	}
+
+	if target == "" {
+		return "<div>webhook removed</div>"
+	}
+	signed := "<div>requests are signed with your secret " + html.EscapeString(userWebhookSecret(user)) + ", see X-RSS-Email-Signature</div>"
+	if len(feeds) == 0 {
+		return "<div>new items of every feed are POSTed to " + html.EscapeString(target) + "</div>" + signed
+	}
+	return "<div>new items of " + html.EscapeString(strings.Join(feeds, ", ")) + " are POSTed to " + html.EscapeString(target) + "</div>" + signed
+}
+
+// testWebhook queues a sample payload for url in the outbox.
+func testWebhook(config *emailConfig, user, url string) error {
+	now := time.Now()
+	b, err := json.Marshal(&webhookPayload{Items: []webhookItem{{
+		Feed:      "rss-email",
+		FeedURL:   "https://github.com/derekchuank/rss-email",
+		Title:     "rss-email webhook test",
+		Link:      "https://github.com/derekchuank/rss-email",
+		Published: &now,
+		Content:   "This is a test item, your webhook works.",
+	}}})
+	if err != nil {
+		return err
+	}
+
+	return queueMessage(config, &outboxMessage{To: user, Via: deliverWebhook, Path: url, Data: b})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func Test_postWebhook(t *testing.T) {
+	config := &emailConfig{webhookSecret: "secret", allowPrivate: []string{"127.0.0.1"}}
+
+	var gotSignature, wantSignature, gotServerSignature, wantServerSignature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		gotSignature = r.Header.Get("X-RSS-Email-Signature")
+		wantSignature = "sha256=" + signWebhook("user secret", r.Header.Get("X-RSS-Email-Timestamp"), body)
+		gotServerSignature = r.Header.Get("X-RSS-Email-Server-Signature")
+		wantServerSignature = "sha256=" + signWebhook("secret", r.Header.Get("X-RSS-Email-Timestamp"), body)
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if r.URL.Path == "/busy" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer server.Close()
+
+	if err := postWebhook(config, server.URL+"/ok", "id", "user secret", []byte(`{"items":[]}`)); err != nil {
+		t.Errorf("postWebhook error %q", err)
+	}
+	if gotSignature != wantSignature || gotServerSignature != wantServerSignature {
+		t.Errorf("signatures %q and %q, want %q and %q", gotSignature, gotServerSignature, wantSignature, wantServerSignature)
+	}
+
+	if err := postWebhook(config, server.URL+"/gone", "id", "", nil); err == nil || !isPermanentError(err) {
+		t.Errorf("postWebhook on 410 == %v, want permanent error", err)
+	}
+	if err := postWebhook(config, server.URL+"/busy", "id", "", nil); err == nil || isPermanentError(err) {
+		t.Errorf("postWebhook on 503 == %v, want temporary error", err)
+	}
+
+	// loopback is refused unless allowed
+	for _, target := range []string{server.URL + "/ok", strings.Replace(server.URL, "127.0.0.1", "localhost", 1) + "/ok"} {
+		if err := postWebhook(&emailConfig{}, target, "id", "", nil); !errors.Is(err, errPrivateAddress) || !isPermanentError(err) {
+			t.Errorf("postWebhook to %s == %v, want %v", target, err, errPrivateAddress)
+		}
+	}
+	if err := postWebhook(&emailConfig{allowPrivate: []string{"127.0.0.0/8"}}, server.URL+"/ok", "id", "", nil); err != nil {
+		t.Errorf("postWebhook to allowed network error %q", err)
+	}
+}
+
+func Test_runWebhookCommandSecret(t *testing.T) {
+	m, prefs := userSubscriptions.m, userSubscriptions.prefs
+	t.Cleanup(func() { userSubscriptions.m, userSubscriptions.prefs = m, prefs })
+	userSubscriptions.m, userSubscriptions.prefs = make(map[string]*userSubscriptionType), make(map[string]*userPreference)
+
+	msg, err := mail.ReadMessage(strings.NewReader("Subject: rss-email webhook\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"a@example.com", "b@example.com"} {
+		subscribeUser(user, []string{"https://a.example.com/feed"})
+		reply := runWebhookCommand(&emailConfig{}, user, userSubscriptions.m[user], msg, "https://hooks.example.com/"+user)
+		secret := userSubscriptions.pref(user).WebhookSecret
+		if secret == "" || !strings.Contains(reply, secret) {
+			t.Errorf("reply to %s %q lacks its secret %q", user, reply, secret)
+		}
+	}
+	// a user's signed requests can't pass as another's
+	if userSubscriptions.pref("a@example.com").WebhookSecret == userSubscriptions.pref("b@example.com").WebhookSecret {
+		t.Error("users share a webhook secret")
+	}
+}